@@ -22,6 +22,20 @@ package labrpc
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+// net.SetEndOwner(endname, servername) -- the end sends on behalf of
+//   that server, so Partition() and BlockLink() apply to it.
+// net.Partition(groups...) -- servers can only reach servers that
+//   share a group with them, e.g. Partition([]interface{}{0, 1, 2},
+//   []interface{}{2, 3, 4}) makes 2 a bridge between two sides. a
+//   server in no group can reach no other server.
+// net.BlockLink(from, to) -- lose every message that server from
+//   sends to server to: its requests to to, and its replies to to's
+//   requests. the opposite direction is unaffected.
+// net.UnblockLink(from, to) -- undo BlockLink(from, to).
+// net.Heal() -- undo Partition() and every BlockLink().
+// ends without an owner (e.g. those of clients) are never cut off.
+//
+// see profile.go for per-link latency, loss, &c.
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
 // the "Raft" is the name of the server struct to be called.
@@ -37,6 +51,9 @@ package labrpc
 // Call() is guaranteed to return (perhaps after a delay) *except* if the
 // handler function on the server side does not return. That is, there
 // is no need to implement your own timeouts around Call().
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- like
+// Call(), but returns as soon as ctx is done, and returns an error
+// saying why there was no reply instead of false.
 // the server RPC handler function must declare its args and reply arguments
 // as pointers, so that their types exactly match the types of the arguments
 // to Call().
@@ -49,9 +66,13 @@ package labrpc
 //   much like Go's rpcs.Register()
 //   pass svc to srv.AddService()
 //
+// see tcp.go for ClientEnds and Servers that talk over TCP instead.
+//
 
 import "encoding/gob"
 import "bytes"
+import "context"
+import "errors"
 import "reflect"
 import "sync"
 import "log"
@@ -65,43 +86,105 @@ type reqMsg struct {
 	argsType reflect.Type
 	args     []byte
 	replyCh  chan replyMsg
+	done     <-chan struct{} // closed once the caller has given up
 }
 
 type replyMsg struct {
 	ok    bool
 	reply []byte
+	err   error // why there's no reply, if !ok
 }
 
+var (
+	ErrTimeout       = errors.New("labrpc: timed out waiting for the reply")
+	ErrDisconnected  = errors.New("labrpc: the end is disabled, unconnected, or cut off from its server")
+	ErrServerDeleted = errors.New("labrpc: the server was deleted")
+	ErrDropped       = errors.New("labrpc: the network dropped the request or the reply")
+	ErrUnknownMethod = errors.New("labrpc: the server has no such service or method")
+)
+
 type ClientEnd struct {
 	endname interface{} // this end-point's name
 	ch      chan reqMsg // copy of Network.endCh
+	tcp     *tcpEnd     // non-nil for an end made by MakeTCPEnd()
 }
 
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
 // no reply was received from the server.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+//
+// send an RPC, and wait for the reply or until ctx is done.
+// returns nil if the server executed the request and the reply is
+// valid. otherwise returns why no reply was received: ErrTimeout if
+// ctx's deadline (or a TCP end's timeout) passed, ctx.Err() if ctx
+// was canceled, or ErrDisconnected, ErrServerDeleted, ErrDropped or
+// ErrUnknownMethod. the server may still execute a request after
+// CallContext() has given up on it.
+//
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	if ctx.Err() != nil {
+		return contextError(ctx)
+	}
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	// buffered, so the network never blocks on a caller that gave up.
+	req.replyCh = make(chan replyMsg, 1)
+	req.done = ctx.Done()
 
 	qb := new(bytes.Buffer)
 	qe := gob.NewEncoder(qb)
 	qe.Encode(args)
 	req.args = qb.Bytes()
 
-	e.ch <- req
-	rep := <-req.replyCh
+	var rep replyMsg
+	if e.tcp != nil {
+		rep = e.tcp.call(ctx, svcMeth, req.args)
+	} else {
+		select {
+		case e.ch <- req:
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+		select {
+		case rep = <-req.replyCh:
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+	}
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := gob.NewDecoder(rb)
 		if err := rd.Decode(reply); err != nil {
 			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
 		}
-		return true
+		return nil
 	} else {
+		return rep.err
+	}
+}
+
+// the error for a call given up because ctx is done.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// sleep for d, or until done is closed. returns false if done was closed.
+func sleepUnless(d time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
 		return false
 	}
 }
@@ -115,9 +198,20 @@ type Network struct {
 	enabled        map[interface{}]bool        // by end name
 	servers        map[interface{}]*Server     // servers, by name
 	connections    map[interface{}]interface{} // endname -> servername
+	owners         map[interface{}]interface{} // endname -> servername it sends for
+	blocked        map[link]bool               // links cut by BlockLink()
+	groups         [][]interface{}             // from Partition(), if partitioned
+	partitioned    bool
+	profiles       map[link]*linkState // links with a LinkProfile
 	endCh          chan reqMsg
 }
 
+// messages from one server to another.
+type link struct {
+	from interface{}
+	to   interface{}
+}
+
 func MakeNetwork() *Network {
 	rn := &Network{}
 	rn.reliable = true
@@ -125,6 +219,9 @@ func MakeNetwork() *Network {
 	rn.enabled = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.owners = map[interface{}]interface{}{}
+	rn.blocked = map[link]bool{}
+	rn.profiles = map[link]*linkState{}
 	rn.endCh = make(chan reqMsg)
 
 	// single goroutine to handle all ClientEnd.Call()s
@@ -164,8 +261,8 @@ func (rn *Network) ReadEndnameInfo(endname interface{}) (enabled bool,
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	enabled = rn.enabled[endname]
 	servername = rn.connections[endname]
+	enabled = rn.enabled[endname] && rn.canReach(rn.owners[endname], servername)
 	if servername != nil {
 		server = rn.servers[servername]
 	}
@@ -175,18 +272,65 @@ func (rn *Network) ReadEndnameInfo(endname interface{}) (enabled bool,
 }
 
 func (rn *Network) IsServerDead(endname interface{}, servername interface{}, server *Server) bool {
+	return rn.deadReason(endname, servername, server) != nil
+}
+
+// why server can no longer reply to endname, or nil if it still can.
+func (rn *Network) deadReason(endname interface{}, servername interface{}, server *Server) error {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.enabled[endname] == false || rn.servers[servername] != server {
+	if rn.enabled[endname] == false {
+		return ErrDisconnected
+	}
+	if rn.servers[servername] != server {
+		return ErrServerDeleted
+	}
+	// the reply travels back from the server to the end's owner.
+	if !rn.canReach(servername, rn.owners[endname]) {
+		return ErrDisconnected
+	}
+	return nil
+}
+
+// whether messages from server from get to server to.
+// nil stands for an end without an owner. rn.mu must be held.
+func (rn *Network) canReach(from interface{}, to interface{}) bool {
+	if from == nil || to == nil {
+		return true
+	}
+	if rn.blocked[link{from, to}] {
+		return false
+	}
+	if !rn.partitioned {
 		return true
 	}
+	for _, group := range rn.groups {
+		if contains(group, from) && contains(group, to) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(group []interface{}, servername interface{}) bool {
+	for _, s := range group {
+		if s == servername {
+			return true
+		}
+	}
 	return false
 }
 
 func (rn *Network) ProcessReq(req reqMsg) {
 	enabled, servername, server, reliable, longreordering := rn.ReadEndnameInfo(req.endname)
 	if enabled && servername != nil && server != nil {
+		if out, back, ok := rn.linkProfiles(req.endname, servername); ok {
+			// the link's profile replaces Reliable() and LongReordering().
+			rn.processOnLink(req, servername, server, out, back)
+			return
+		}
+
 		if reliable == false {
 			// short delay
 			ms := (rand.Int() % 27)
@@ -195,60 +339,37 @@ func (rn *Network) ProcessReq(req reqMsg) {
 
 		if reliable == false && (rand.Int()%1000) < 100 {
 			// drop the request, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			req.replyCh <- replyMsg{false, nil, ErrDropped}
 			return
 		}
 
-		// execute the request (call the RPC handler).
-		// in a separate thread so that we can periodically check
-		// if the server has been killed and the RPC should get a
-		// failure reply.
-		ech := make(chan replyMsg)
-		go func() {
-			r := server.dispatch(req)
-			ech <- r
-		}()
-		// wait for handler to return,
-		// but stop waiting if DeleteServer() has been called,
-		// and return an error.
-		var reply replyMsg
-		replyOK := false
-		serverDead := false
-		for replyOK == false && serverDead == false {
-			select {
-			case reply = <-ech:
-				replyOK = true
-			case <-time.After(100 * time.Millisecond):
-				serverDead = rn.IsServerDead(req.endname, servername, server)
-			}
+		reply, answered := rn.execute(req, servername, server)
+		if answered == false {
+			return
 		}
 
-		// do not reply if DeleteServer() has been called, i.e.
-		// the server has been killed. this is needed to avoid
-		// situation in which a client gets a positive reply
-		// to an Append, but the server persisted the update
-		// into the old Persister. config.go is careful to call
-		// DeleteServer() before superseding the Persister.
-		serverDead = rn.IsServerDead(req.endname, servername, server)
-
-		if replyOK == false || serverDead == true {
+		if reply.ok == false {
 			// server was killed while we were waiting; return error.
-			req.replyCh <- replyMsg{false, nil}
+			req.replyCh <- reply
 		} else if reliable == false && (rand.Int()%1000) < 100 {
 			// drop the reply, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			req.replyCh <- replyMsg{false, nil, ErrDropped}
 		} else if longreordering == true && rand.Intn(900) < 600 {
 			// delay the response for a while
 			ms := 200 + rand.Intn(1+rand.Intn(2000))
-			time.Sleep(time.Duration(ms) * time.Millisecond)
-			req.replyCh <- reply
+			if sleepUnless(time.Duration(ms)*time.Millisecond, req.done) {
+				req.replyCh <- reply
+			}
 		} else {
 			req.replyCh <- reply
 		}
 	} else {
 		// simulate no reply and eventual timeout.
 		ms := 0
-		if rn.longDelays {
+		rn.mu.Lock()
+		longDelays := rn.longDelays
+		rn.mu.Unlock()
+		if longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
 			ms = (rand.Int() % 7000)
@@ -257,10 +378,60 @@ func (rn *Network) ProcessReq(req reqMsg) {
 			// server in fairly rapid succession.
 			ms = (rand.Int() % 100)
 		}
-		time.Sleep(time.Duration(ms) * time.Millisecond)
-		req.replyCh <- replyMsg{false, nil}
+		err := ErrDisconnected
+		if enabled && servername != nil {
+			err = ErrServerDeleted
+		}
+		if sleepUnless(time.Duration(ms)*time.Millisecond, req.done) {
+			req.replyCh <- replyMsg{false, nil, err}
+		}
+	}
+
+}
+
+// execute the request (call the RPC handler), and return the reply,
+// or a failed reply if the server was deleted or the end cut off in
+// the meantime. returns false if the caller gave up first.
+func (rn *Network) execute(req reqMsg, servername interface{}, server *Server) (replyMsg, bool) {
+	// in a separate thread so that we can periodically check
+	// if the server has been killed and the RPC should get a
+	// failure reply.
+	ech := make(chan replyMsg)
+	go func() {
+		r := server.dispatch(req)
+		ech <- r
+	}()
+	// wait for handler to return,
+	// but stop waiting if DeleteServer() has been called,
+	// and return an error.
+	// stop waiting, too, once the caller has given up.
+	var reply replyMsg
+	var dead error
+	replyOK := false
+	for replyOK == false && dead == nil {
+		select {
+		case reply = <-ech:
+			replyOK = true
+		case <-time.After(100 * time.Millisecond):
+			dead = rn.deadReason(req.endname, servername, server)
+		case <-req.done:
+			return replyMsg{}, false
+		}
 	}
 
+	// do not reply if DeleteServer() has been called, i.e.
+	// the server has been killed. this is needed to avoid
+	// situation in which a client gets a positive reply
+	// to an Append, but the server persisted the update
+	// into the old Persister. config.go is careful to call
+	// DeleteServer() before superseding the Persister.
+	if err := rn.deadReason(req.endname, servername, server); err != nil {
+		dead = err
+	}
+	if dead != nil {
+		return replyMsg{false, nil, dead}, true
+	}
+	return reply, true
 }
 
 // create a client end-point.
@@ -306,6 +477,53 @@ func (rn *Network) Connect(endname interface{}, servername interface{}) {
 	rn.connections[endname] = servername
 }
 
+// the ClientEnd sends on behalf of the named server.
+func (rn *Network) SetEndOwner(endname interface{}, servername interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.owners[endname] = servername
+}
+
+// split the servers into groups that can only reach each other.
+// a server may be in more than one group. replaces any previous
+// Partition(), but not BlockLink()s.
+func (rn *Network) Partition(groups ...[]interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = nil
+	for _, group := range groups {
+		rn.groups = append(rn.groups, append([]interface{}{}, group...))
+	}
+	rn.partitioned = true
+}
+
+// lose all messages from server from to server to.
+func (rn *Network) BlockLink(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.blocked[link{from, to}] = true
+}
+
+func (rn *Network) UnblockLink(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	delete(rn.blocked, link{from, to})
+}
+
+// undo Partition() and all BlockLink()s.
+func (rn *Network) Heal() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = nil
+	rn.partitioned = false
+	rn.blocked = map[link]bool{}
+}
+
 // enable/disable a ClientEnd.
 func (rn *Network) Enable(endname interface{}, enabled bool) {
 	rn.mu.Lock()
@@ -369,7 +587,7 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 		}
 		log.Fatalf("labrpc.Server.dispatch(): unknown service %v in %v.%v; expecting one of %v\n",
 			serviceName, serviceName, methodName, choices)
-		return replyMsg{false, nil}
+		return replyMsg{false, nil, ErrUnknownMethod}
 	}
 }
 
@@ -422,8 +640,13 @@ func MakeService(rcvr interface{}) *Service {
 func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// prepare space into which to read the argument.
-		// the Value's type will be a pointer to req.argsType.
-		args := reflect.New(req.argsType)
+		// the Value's type will be a pointer to req.argsType,
+		// or to the handler's args type for a TCP request.
+		argsType := req.argsType
+		if argsType == nil {
+			argsType = method.Type.In(1)
+		}
+		args := reflect.New(argsType)
 
 		// decode the argument.
 		ab := bytes.NewBuffer(req.args)
@@ -444,7 +667,7 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 		re := gob.NewEncoder(rb)
 		re.EncodeValue(replyv)
 
-		return replyMsg{true, rb.Bytes()}
+		return replyMsg{true, rb.Bytes(), nil}
 	} else {
 		choices := []string{}
 		for k, _ := range svc.methods {
@@ -452,6 +675,6 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 		}
 		log.Fatalf("labrpc.Service.dispatch(): unknown method %v in %v; expecting one of %v\n",
 			methname, req.svcMeth, choices)
-		return replyMsg{false, nil}
+		return replyMsg{false, nil, ErrUnknownMethod}
 	}
 }
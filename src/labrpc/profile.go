@@ -0,0 +1,183 @@
+package labrpc
+
+//
+// per-link fault profiles, e.g. for a slow WAN replica or a flaky
+// rack next to healthy links in the same test.
+//
+// net.SetLinkProfile(from, to, LinkProfile{...}) -- messages from
+//   server from to server to (its requests to to, and its replies to
+//   to's requests) are delayed, lost, duplicated and rate-limited as
+//   the profile says. set both directions for a symmetric link.
+// net.ClearLinkProfile(from, to) -- back to the global policy.
+//
+// a request travels on link (owner, server) and its reply on link
+// (server, owner), where owner is the end's SetEndOwner(). if either
+// has a profile, the message pair ignores Reliable() and
+// LongReordering(); a direction without a profile is then perfect.
+// ends without an owner never use profiles. profiles survive Heal(),
+// and a link cut by Partition() or BlockLink() loses everything
+// whatever its profile.
+//
+
+import "math/rand"
+import "time"
+
+// how a Jitter is distributed.
+type Distribution int
+
+const (
+	Uniform     Distribution = iota // uniform in [0, Jitter)
+	Exponential                     // exponential with mean Jitter
+	Normal                          // |N(0, Jitter)|, half-normal
+)
+
+// the faults of one direction of a link.
+type LinkProfile struct {
+	Latency     time.Duration // added to every message
+	Jitter      time.Duration // scale of a random extra delay per message
+	JitterDist  Distribution  // how the extra delay is distributed
+	LossRate    float64       // probability that a message is lost
+	DupRate     float64       // probability that a request is executed twice
+	ReorderRate float64       // probability that a message is held back 200ms-2.2s
+	Bandwidth   int           // bytes per second of gob payload; 0 is unlimited
+}
+
+// a link's profile, and when its bandwidth is next free.
+type linkState struct {
+	profile   LinkProfile
+	busyUntil time.Time
+}
+
+func (rn *Network) SetLinkProfile(from interface{}, to interface{}, p LinkProfile) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.profiles[link{from, to}] = &linkState{profile: p}
+}
+
+func (rn *Network) ClearLinkProfile(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	delete(rn.profiles, link{from, to})
+}
+
+// the links a request from endname to servername and its reply
+// travel on, and whether either of them has a profile.
+func (rn *Network) linkProfiles(endname interface{}, servername interface{}) (link, link, bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	owner := rn.owners[endname]
+	out := link{owner, servername}
+	back := link{servername, owner}
+	if owner == nil {
+		return out, back, false
+	}
+	_, ok1 := rn.profiles[out]
+	_, ok2 := rn.profiles[back]
+	return out, back, ok1 || ok2
+}
+
+// send a message of n bytes on l. returns how long it takes to
+// arrive, or false if it's lost.
+func (rn *Network) transmit(l link, n int) (time.Duration, bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	ls := rn.profiles[l]
+	if ls == nil {
+		return 0, true
+	}
+	p := ls.profile
+	d := p.Latency + p.jitter()
+	if p.Bandwidth > 0 {
+		// messages queue up behind each other on the link.
+		now := time.Now()
+		start := now
+		if ls.busyUntil.After(now) {
+			start = ls.busyUntil
+		}
+		ls.busyUntil = start.Add(time.Duration(n) * time.Second / time.Duration(p.Bandwidth))
+		d += ls.busyUntil.Sub(now)
+	}
+	if rand.Float64() < p.LossRate {
+		return 0, false
+	}
+	if rand.Float64() < p.ReorderRate {
+		d += time.Duration(200+rand.Intn(2000)) * time.Millisecond
+	}
+	return d, true
+}
+
+func (p LinkProfile) jitter() time.Duration {
+	if p.Jitter <= 0 {
+		return 0
+	}
+	switch p.JitterDist {
+	case Exponential:
+		return time.Duration(rand.ExpFloat64() * float64(p.Jitter))
+	case Normal:
+		x := rand.NormFloat64()
+		if x < 0 {
+			x = -x
+		}
+		return time.Duration(x * float64(p.Jitter))
+	default:
+		return time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+}
+
+// whether a request on l should be executed a second time.
+func (rn *Network) duplicate(l link) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	ls := rn.profiles[l]
+	return ls != nil && rand.Float64() < ls.profile.DupRate
+}
+
+// like the rest of ProcessReq(), but for a request whose request or
+// reply link has a profile.
+func (rn *Network) processOnLink(req reqMsg, servername interface{}, server *Server, out link, back link) {
+	d, ok := rn.transmit(out, len(req.args))
+	if !ok {
+		// lost on the way, return as if timeout
+		req.replyCh <- replyMsg{false, nil, ErrDropped}
+		return
+	}
+	if !sleepUnless(d, req.done) {
+		return
+	}
+
+	if rn.duplicate(out) {
+		// the copy arrives on its own schedule, even if the caller
+		// gives up, and its reply goes nowhere.
+		dup := req
+		dup.done = nil
+		go func() {
+			if d, ok := rn.transmit(out, len(dup.args)); ok {
+				time.Sleep(d)
+				rn.execute(dup, servername, server)
+			}
+		}()
+	}
+
+	reply, answered := rn.execute(req, servername, server)
+	if !answered {
+		return
+	}
+	if !reply.ok {
+		req.replyCh <- reply
+		return
+	}
+	d, ok = rn.transmit(back, len(reply.reply))
+	if !ok {
+		// drop the reply, return as if timeout
+		req.replyCh <- replyMsg{false, nil, ErrDropped}
+		return
+	}
+	if sleepUnless(d, req.done) {
+		req.replyCh <- reply
+	}
+}
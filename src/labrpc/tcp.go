@@ -0,0 +1,337 @@
+package labrpc
+
+//
+// the same RPCs over real TCP connections, so that servers can run
+// as separate processes.
+//
+// srv := MakeServer(); srv.AddService(svc) -- exactly as above.
+// ts, err := ServeTCP(srv, "127.0.0.1:8000") -- serve srv on a TCP address.
+// ts.Addr() -- the address it listens on, e.g. if the port was 0.
+// ts.Close() -- stop listening and drop all connections.
+//
+// end := MakeTCPEnd("127.0.0.1:8000", timeout) -- a ClientEnd that
+//   talks to the server at that address.
+// end.Call("Raft.AppendEntries", &args, &reply) -- as above. Call()
+//   returns false if it can't reach the server or gets no reply within
+//   timeout, so Call() always returns, even if the handler doesn't.
+//   CallContext() also gives up at ctx's deadline if that's sooner.
+//
+// a TCP ClientEnd dials its server on the first Call(), and shares
+// the connection between concurrent Call()s. once the connection
+// breaks, Call()s in progress return false and the next Call() dials
+// again, so a restarted server is reached without making a new end.
+// unlike a Network, nothing is dropped or delayed on purpose.
+//
+// a request for a service or method the server doesn't have makes
+// Call() return false, and CallContext() ErrUnknownMethod, instead of
+// killing the server. a server that can't be reached, or a connection
+// that breaks, gives ErrDisconnected.
+//
+
+import "bufio"
+import "context"
+import "encoding/gob"
+import "log"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+type tcpRequest struct {
+	Seq     uint64
+	SvcMeth string
+	Args    []byte
+}
+
+type tcpReply struct {
+	Seq   uint64
+	OK    bool
+	Reply []byte
+}
+
+// the client side of a TCP ClientEnd.
+type tcpEnd struct {
+	addr    string
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    *tcpConn // nil before the first Call(), broken after a failure
+}
+
+// one connection from a tcpEnd, with the Call()s waiting on it.
+type tcpConn struct {
+	c       net.Conn
+	wmu     sync.Mutex // serializes requests
+	enc     *gob.Encoder
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan tcpReply
+	broken  bool
+}
+
+// create a client end-point for the server listening on addr.
+func MakeTCPEnd(addr string, timeout time.Duration) *ClientEnd {
+	e := &ClientEnd{}
+	e.endname = addr
+	e.tcp = &tcpEnd{addr: addr, timeout: timeout}
+	return e
+}
+
+// send one request and wait for its reply, or until the timeout or
+// ctx is done.
+func (te *tcpEnd) call(ctx context.Context, svcMeth string, args []byte) replyMsg {
+	deadline := time.Now().Add(te.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	tc, err := te.connect(ctx, deadline)
+	if err != nil {
+		return replyMsg{false, nil, err}
+	}
+	seq, ch := tc.register()
+	if ch == nil {
+		return replyMsg{false, nil, ErrDisconnected}
+	}
+	tc.wmu.Lock()
+	tc.c.SetWriteDeadline(deadline)
+	err = tc.enc.Encode(tcpRequest{seq, svcMeth, args})
+	tc.wmu.Unlock()
+	if err != nil {
+		tc.close()
+		return replyMsg{false, nil, ErrDisconnected}
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case rep, ok := <-ch:
+		if !ok {
+			// the connection broke
+			return replyMsg{false, nil, ErrDisconnected}
+		}
+		if !rep.OK {
+			return replyMsg{false, nil, ErrUnknownMethod}
+		}
+		return replyMsg{true, rep.Reply, nil}
+	case <-timer.C:
+		tc.forget(seq)
+		return replyMsg{false, nil, ErrTimeout}
+	case <-ctx.Done():
+		tc.forget(seq)
+		return replyMsg{false, nil, contextError(ctx)}
+	}
+}
+
+// the current connection, dialing a new one if there is none or it
+// has broken. fails if the server can't be reached by deadline.
+func (te *tcpEnd) connect(ctx context.Context, deadline time.Time) (*tcpConn, error) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if te.conn != nil && !te.conn.isBroken() {
+		return te.conn, nil
+	}
+	d := net.Dialer{Deadline: deadline}
+	c, err := d.DialContext(ctx, "tcp", te.addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, ErrTimeout
+		}
+		return nil, ErrDisconnected
+	}
+	tc := &tcpConn{}
+	tc.c = c
+	tc.enc = gob.NewEncoder(c)
+	tc.pending = map[uint64]chan tcpReply{}
+	te.conn = tc
+	go tc.readReplies()
+	return tc, nil
+}
+
+// deliver replies to the waiting Call()s until the connection breaks.
+func (tc *tcpConn) readReplies() {
+	dec := gob.NewDecoder(bufio.NewReader(tc.c))
+	for {
+		var rep tcpReply
+		if err := dec.Decode(&rep); err != nil {
+			tc.close()
+			return
+		}
+		tc.mu.Lock()
+		ch := tc.pending[rep.Seq]
+		delete(tc.pending, rep.Seq)
+		tc.mu.Unlock()
+		if ch != nil {
+			ch <- rep
+		}
+	}
+}
+
+// allocate a sequence number and a channel for its reply.
+// the channel is nil if the connection has already broken.
+func (tc *tcpConn) register() (uint64, chan tcpReply) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.broken {
+		return 0, nil
+	}
+	tc.seq++
+	ch := make(chan tcpReply, 1)
+	tc.pending[tc.seq] = ch
+	return tc.seq, ch
+}
+
+// stop waiting for a reply; a late one is discarded.
+func (tc *tcpConn) forget(seq uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.pending, seq)
+}
+
+func (tc *tcpConn) isBroken() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.broken
+}
+
+// close the connection and fail the Call()s waiting on it.
+func (tc *tcpConn) close() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.broken {
+		return
+	}
+	tc.broken = true
+	tc.c.Close()
+	for _, ch := range tc.pending {
+		close(ch)
+	}
+	tc.pending = nil
+}
+
+//
+// serves a Server's services to TCP ClientEnds.
+//
+type TCPServer struct {
+	mu     sync.Mutex
+	srv    *Server
+	ln     net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// listen on addr and serve srv's services until Close().
+func ServeTCP(srv *Server, addr string) (*TCPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ts := &TCPServer{}
+	ts.srv = srv
+	ts.ln = ln
+	ts.conns = map[net.Conn]bool{}
+	go ts.accept()
+	return ts, nil
+}
+
+// the address the server listens on.
+func (ts *TCPServer) Addr() string {
+	return ts.ln.Addr().String()
+}
+
+// stop listening and close all connections. handlers already running
+// finish, but their replies are dropped.
+func (ts *TCPServer) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		return nil
+	}
+	ts.closed = true
+	for c := range ts.conns {
+		c.Close()
+	}
+	return ts.ln.Close()
+}
+
+func (ts *TCPServer) isClosed() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.closed
+}
+
+func (ts *TCPServer) accept() {
+	for {
+		c, err := ts.ln.Accept()
+		if err != nil {
+			if ts.isClosed() {
+				return
+			}
+			// e.g. out of file descriptors; try again shortly.
+			log.Printf("labrpc.TCPServer.accept(): %v\n", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		ts.mu.Lock()
+		if ts.closed {
+			ts.mu.Unlock()
+			c.Close()
+			return
+		}
+		ts.conns[c] = true
+		ts.mu.Unlock()
+		go ts.serveConn(c)
+	}
+}
+
+// read requests from one connection, and execute each in its own
+// goroutine, so a slow handler doesn't hold up the others.
+func (ts *TCPServer) serveConn(c net.Conn) {
+	var wmu sync.Mutex
+	enc := gob.NewEncoder(c)
+	dec := gob.NewDecoder(bufio.NewReader(c))
+	for {
+		var req tcpRequest
+		if err := dec.Decode(&req); err != nil {
+			break
+		}
+		go func() {
+			rep := ts.srv.dispatchTCP(req)
+			wmu.Lock()
+			defer wmu.Unlock()
+			if err := enc.Encode(rep); err != nil {
+				c.Close()
+			}
+		}()
+	}
+	c.Close()
+	ts.mu.Lock()
+	delete(ts.conns, c)
+	ts.mu.Unlock()
+}
+
+// like dispatch(), but a request from another process for a service or
+// method this server doesn't have fails, rather than killing the server.
+func (rs *Server) dispatchTCP(req tcpRequest) tcpReply {
+	rep := tcpReply{Seq: req.Seq}
+	dot := strings.LastIndex(req.SvcMeth, ".")
+	if dot < 0 {
+		return rep
+	}
+	rs.mu.Lock()
+	service, ok := rs.services[req.SvcMeth[:dot]]
+	rs.mu.Unlock()
+	if !ok {
+		return rep
+	}
+	if _, ok := service.methods[req.SvcMeth[dot+1:]]; !ok {
+		return rep
+	}
+	// the args' type comes from the handler, since the caller's
+	// reflect.Type can't cross the connection.
+	r := rs.dispatch(reqMsg{svcMeth: req.SvcMeth, args: req.Args})
+	rep.OK = r.ok
+	rep.Reply = r.reply
+	return rep
+}
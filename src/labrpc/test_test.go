@@ -1,6 +1,7 @@
 package labrpc
 
 import "testing"
+import "context"
 import "strconv"
 import "sync"
 import "runtime"
@@ -514,3 +515,467 @@ func TestBenchmark(t *testing.T) {
 	fmt.Printf("%v for %v\n", time.Since(t0), n)
 	// march 2016, rtm laptop, 22 microseconds per RPC
 }
+
+//
+// the same handlers, over TCP.
+//
+func TestTCPBasic(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	ts, err := ServeTCP(rs, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeTCP(): %v", err)
+	}
+	defer ts.Close()
+
+	e := MakeTCPEnd(ts.Addr(), time.Second)
+
+	{
+		reply := ""
+		if ok := e.Call("JunkServer.Handler2", 111, &reply); !ok || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+
+	{
+		var args JunkArgs
+		var reply JunkReply
+		if ok := e.Call("JunkServer.Handler4", &args, &reply); !ok || reply.X != "pointer" {
+			t.Fatalf("wrong reply from Handler4")
+		}
+	}
+
+	{
+		var args JunkArgs
+		var reply JunkReply
+		if ok := e.Call("JunkServer.Handler5", args, &reply); !ok || reply.X != "no pointer" {
+			t.Fatalf("wrong reply from Handler5")
+		}
+	}
+
+	// an unknown method fails the call, but not the server.
+	{
+		reply := 0
+		if e.Call("JunkServer.NoSuchHandler", 1, &reply) {
+			t.Fatalf("call to an unknown method succeeded")
+		}
+		if e.Call("NoSuchServer.Handler2", 1, &reply) {
+			t.Fatalf("call to an unknown service succeeded")
+		}
+	}
+
+	if n := rs.GetCount(); n != 3 {
+		t.Fatalf("wrong GetCount() %v, expected 3", n)
+	}
+}
+
+//
+// many concurrent Call()s share one connection.
+//
+func TestTCPConcurrentMany(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	ts, err := ServeTCP(rs, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeTCP(): %v", err)
+	}
+	defer ts.Close()
+
+	e := MakeTCPEnd(ts.Addr(), 5*time.Second)
+	ch := make(chan int)
+
+	nclients := 20
+	nrpcs := 10
+	for ii := 0; ii < nclients; ii++ {
+		go func(i int) {
+			n := 0
+			defer func() { ch <- n }()
+			for j := 0; j < nrpcs; j++ {
+				arg := i*100 + j
+				reply := ""
+				e.Call("JunkServer.Handler2", arg, &reply)
+				if reply == "handler2-"+strconv.Itoa(arg) {
+					n += 1
+				}
+			}
+		}(ii)
+	}
+	total := 0
+	for ii := 0; ii < nclients; ii++ {
+		total += <-ch
+	}
+	if total != nclients*nrpcs {
+		t.Fatalf("wrong number of RPCs completed, got %v, expected %v", total, nclients*nrpcs)
+	}
+}
+
+//
+// Call() gives up after the timeout, even if the handler
+// doesn't return, and fails right away if nothing listens.
+//
+func TestTCPTimeout(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	ts, err := ServeTCP(rs, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeTCP(): %v", err)
+	}
+	defer ts.Close()
+
+	e := MakeTCPEnd(ts.Addr(), 500*time.Millisecond)
+	t0 := time.Now()
+	reply := 0
+	if e.Call("JunkServer.Handler3", 99, &reply) {
+		t.Fatalf("Handler3 replied before its 20 second sleep")
+	}
+	if d := time.Since(t0); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("Call() returned after %v, expected after the 500ms timeout", d)
+	}
+
+	addr := ts.Addr()
+	ts.Close()
+	e = MakeTCPEnd(addr, 5*time.Second)
+	t0 = time.Now()
+	if e.Call("JunkServer.Handler1", "1", &reply) {
+		t.Fatalf("Call() to a closed server succeeded")
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("Call() to a closed server took %v", d)
+	}
+}
+
+//
+// a ClientEnd reconnects to a server that comes back on
+// the same address.
+//
+func TestTCPReconnect(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	ts, err := ServeTCP(rs, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeTCP(): %v", err)
+	}
+	addr := ts.Addr()
+
+	e := MakeTCPEnd(addr, time.Second)
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("first call failed")
+	}
+
+	ts.Close()
+	if e.Call("JunkServer.Handler2", 2, &reply) {
+		t.Fatalf("call to a closed server succeeded")
+	}
+
+	// a new server, as if the process had restarted.
+	rs = MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	ts, err = ServeTCP(rs, addr)
+	if err != nil {
+		t.Fatalf("ServeTCP() again: %v", err)
+	}
+	defer ts.Close()
+	reply = ""
+	if !e.Call("JunkServer.Handler2", 3, &reply) || reply != "handler2-3" {
+		t.Fatalf("call after the server restarted failed")
+	}
+}
+
+//
+// CallContext() returns as soon as its context is done, and
+// says why there was no reply.
+//
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := ""
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-111" {
+		t.Fatalf("CallContext() = %v, %v; expected nil, handler2-111", err, reply)
+	}
+
+	// Handler3 sleeps for 20 seconds.
+	n := 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t0 := time.Now()
+	err := e.CallContext(ctx, "JunkServer.Handler3", 99, &n)
+	cancel()
+	if err != ErrTimeout || time.Since(t0) > time.Second {
+		t.Fatalf("CallContext() = %v after %v; expected ErrTimeout after 100ms", err, time.Since(t0))
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &n); err != context.Canceled {
+		t.Fatalf("CallContext() = %v; expected context.Canceled", err)
+	}
+	if err := e.CallContext(ctx, "JunkServer.Handler2", 1, &reply); err != context.Canceled {
+		t.Fatalf("CallContext() with a done context = %v; expected context.Canceled", err)
+	}
+
+	// a disabled end doesn't wait out a long simulated timeout.
+	rn.LongDelays(true)
+	rn.Enable("end1-99", false)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t0 = time.Now()
+	err = e.CallContext(ctx, "JunkServer.Handler2", 1, &reply)
+	cancel()
+	if err != ErrTimeout || time.Since(t0) > time.Second {
+		t.Fatalf("CallContext() on a disabled end = %v after %v; expected ErrTimeout after 100ms", err, time.Since(t0))
+	}
+	rn.LongDelays(false)
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != ErrDisconnected {
+		t.Fatalf("CallContext() on a disabled end = %v; expected ErrDisconnected", err)
+	}
+	if e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("Call() on a disabled end succeeded")
+	}
+
+	rn.Enable("end1-99", true)
+	rn.DeleteServer("server99")
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != ErrServerDeleted {
+		t.Fatalf("CallContext() to a deleted server = %v; expected ErrServerDeleted", err)
+	}
+
+	rs = MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	rn.Reliable(false)
+	dropped := 0
+	for i := 0; i < 100; i++ {
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", i, &reply)
+		if err == ErrDropped {
+			dropped++
+		} else if err != nil {
+			t.Fatalf("CallContext() on an unreliable network = %v", err)
+		}
+	}
+	if dropped == 0 || dropped == 100 {
+		t.Fatalf("%v of 100 calls dropped on an unreliable network", dropped)
+	}
+}
+
+func TestTCPCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	ts, err := ServeTCP(rs, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeTCP(): %v", err)
+	}
+
+	// the context's deadline is sooner than the end's timeout.
+	e := MakeTCPEnd(ts.Addr(), 10*time.Second)
+	n := 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t0 := time.Now()
+	err = e.CallContext(ctx, "JunkServer.Handler3", 99, &n)
+	cancel()
+	if err != ErrTimeout || time.Since(t0) > time.Second {
+		t.Fatalf("CallContext() = %v after %v; expected ErrTimeout after 100ms", err, time.Since(t0))
+	}
+
+	if err := e.CallContext(context.Background(), "JunkServer.NoSuchHandler", 1, &n); err != ErrUnknownMethod {
+		t.Fatalf("CallContext() of an unknown method = %v; expected ErrUnknownMethod", err)
+	}
+
+	ts.Close()
+	reply := ""
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != ErrDisconnected {
+		t.Fatalf("CallContext() to a closed server = %v; expected ErrDisconnected", err)
+	}
+}
+
+//
+// Partition() and BlockLink() cut off servers' ends, in one or
+// both directions, but not ends without an owner.
+//
+func TestLinks(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	servers := []string{"s1", "s2", "s3"}
+	js := map[string]*JunkServer{}
+	ends := map[string]*ClientEnd{} // "s1-s2" is s1's end to s2
+	for _, s := range servers {
+		js[s] = &JunkServer{}
+		rs := MakeServer()
+		rs.AddService(MakeService(js[s]))
+		rn.AddServer(s, rs)
+	}
+	for _, from := range servers {
+		for _, to := range servers {
+			endname := from + "-" + to
+			ends[endname] = rn.MakeEnd(endname)
+			rn.Connect(endname, to)
+			rn.Enable(endname, true)
+			rn.SetEndOwner(endname, from)
+		}
+	}
+	client := rn.MakeEnd("client-s1")
+	rn.Connect("client-s1", "s1")
+	rn.Enable("client-s1", true)
+
+	check := func(from string, to string, expected error) {
+		reply := ""
+		if err := ends[from+"-"+to].CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != expected {
+			t.Fatalf("%v -> %v: CallContext() = %v; expected %v", from, to, err, expected)
+		}
+	}
+	handled := func(s string) int {
+		js[s].mu.Lock()
+		defer js[s].mu.Unlock()
+		return len(js[s].log2)
+	}
+
+	// s2 can't reach s1, but s1's requests still get to s2, which
+	// executes them even though the replies are lost.
+	rn.BlockLink("s2", "s1")
+	check("s2", "s1", ErrDisconnected)
+	n := handled("s2")
+	check("s1", "s2", ErrDisconnected)
+	if handled("s2") != n+1 {
+		t.Fatalf("s2 didn't execute s1's request")
+	}
+	check("s1", "s3", nil)
+	check("s3", "s1", nil)
+	rn.UnblockLink("s2", "s1")
+	check("s2", "s1", nil)
+	check("s1", "s2", nil)
+
+	// s2 bridges {s1, s2} and {s2, s3}.
+	rn.Partition([]interface{}{"s1", "s2"}, []interface{}{"s2", "s3"})
+	check("s1", "s2", nil)
+	check("s2", "s3", nil)
+	check("s3", "s2", nil)
+	check("s1", "s3", ErrDisconnected)
+	check("s3", "s1", ErrDisconnected)
+	reply := ""
+	if !client.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("a client end was cut off by Partition()")
+	}
+
+	rn.Partition([]interface{}{"s1"}, []interface{}{"s2", "s3"})
+	check("s1", "s2", ErrDisconnected)
+	check("s3", "s2", nil)
+	rn.BlockLink("s3", "s2")
+	check("s3", "s2", ErrDisconnected)
+
+	rn.Heal()
+	for _, from := range servers {
+		for _, to := range servers {
+			check(from, to, nil)
+		}
+	}
+}
+
+//
+// a LinkProfile delays, drops, duplicates and rate-limits messages
+// on its own link only.
+//
+func TestLinkProfile(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	js := map[string]*JunkServer{}
+	ends := map[string]*ClientEnd{}
+	for _, s := range []string{"s1", "s2", "s3"} {
+		js[s] = &JunkServer{}
+		rs := MakeServer()
+		rs.AddService(MakeService(js[s]))
+		rn.AddServer(s, rs)
+	}
+	for _, to := range []string{"s2", "s3"} {
+		endname := "s1-" + to
+		ends[to] = rn.MakeEnd(endname)
+		rn.Connect(endname, to)
+		rn.Enable(endname, true)
+		rn.SetEndOwner(endname, "s1")
+	}
+	timed := func(to string, args string) (time.Duration, error) {
+		t0 := time.Now()
+		reply := 0
+		err := ends[to].CallContext(context.Background(), "JunkServer.Handler1", args, &reply)
+		return time.Since(t0), err
+	}
+	calls := func(s string) int {
+		js[s].mu.Lock()
+		defer js[s].mu.Unlock()
+		return len(js[s].log1)
+	}
+
+	// latency applies in both directions, and only to s1 <-> s2.
+	p := LinkProfile{Latency: 100 * time.Millisecond, Jitter: 20 * time.Millisecond, JitterDist: Exponential}
+	rn.SetLinkProfile("s1", "s2", p)
+	rn.SetLinkProfile("s2", "s1", p)
+	if d, err := timed("s2", "1"); err != nil || d < 200*time.Millisecond {
+		t.Fatalf("call on a 100ms link: %v after %v", err, d)
+	}
+	if d, err := timed("s3", "1"); err != nil || d > 100*time.Millisecond {
+		t.Fatalf("call on a healthy link: %v after %v", err, d)
+	}
+
+	// 5000 bytes at 10000 bytes/second take half a second.
+	rn.SetLinkProfile("s1", "s2", LinkProfile{Bandwidth: 10000})
+	rn.ClearLinkProfile("s2", "s1")
+	if d, err := timed("s2", string(make([]byte, 5000))); err != nil || d < 400*time.Millisecond {
+		t.Fatalf("5000 bytes at 10000 bytes/second: %v after %v", err, d)
+	}
+
+	rn.SetLinkProfile("s1", "s2", LinkProfile{LossRate: 1})
+	if _, err := timed("s2", "1"); err != ErrDropped {
+		t.Fatalf("call on a lossy link = %v; expected ErrDropped", err)
+	}
+	// a lost reply still executes the request.
+	rn.ClearLinkProfile("s1", "s2")
+	rn.SetLinkProfile("s2", "s1", LinkProfile{LossRate: 1})
+	n := calls("s2")
+	if _, err := timed("s2", "1"); err != ErrDropped || calls("s2") != n+1 {
+		t.Fatalf("call with a lossy reply link = %v; expected ErrDropped after executing", err)
+	}
+
+	rn.ClearLinkProfile("s2", "s1")
+	rn.SetLinkProfile("s1", "s2", LinkProfile{DupRate: 1})
+	n = calls("s2")
+	if _, err := timed("s2", "1"); err != nil {
+		t.Fatalf("call on a duplicating link: %v", err)
+	}
+	for start := time.Now(); calls("s2") != n+2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("duplicated request executed %v times", calls("s2")-n)
+		}
+	}
+
+	// a profile replaces the global unreliable policy on its link.
+	rn.Reliable(false)
+	rn.SetLinkProfile("s1", "s2", LinkProfile{})
+	for i := 0; i < 50; i++ {
+		if _, err := timed("s2", "1"); err != nil {
+			t.Fatalf("call on a perfect link of an unreliable network: %v", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package raft
+
+//
+// service的命令怎样变成日志里的字节.
+//
+// 日志项只保存编码之后的命令(Entry.Data), AppendEntries和持久化都不需要知道
+// 命令的Go类型, 日志的格式也就不随service的类型变化, 其他语言的工具也能读.
+// Start()/Propose()用Options.Codec编码命令, apply时再用它解码后交给service,
+// 所以集群里所有server必须使用相同的Codec.
+//
+// 提供三种Codec:
+//   GobCodec   gob编码, 命令的具体类型要gob.Register()(基本类型除外), 默认使用
+//   JSONCodec  JSON编码, 解码成MakeJSONCodec()时给定的类型
+//   RawCodec   命令本身就是[]byte, 加上4字节的长度前缀, 方便按条切分
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var ErrBadRawCommand = errors.New("raft: raw command's length prefix doesn't match its size")
+
+//
+// serializes commands for the log. Decode(Encode(c)) must give back
+// an equivalent command. a Codec must be safe for concurrent use.
+//
+type Codec interface {
+	Encode(command interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// encodes commands with gob; their types must be gob.Register()ed.
+type GobCodec struct{}
+
+func (GobCodec) Encode(command interface{}) ([]byte, error) {
+	w := new(bytes.Buffer)
+	// 编码接口值, 这样解码时能知道具体类型
+	if err := gob.NewEncoder(w).Encode(&command); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte) (interface{}, error) {
+	var command interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&command); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// encodes commands as JSON.
+type JSONCodec struct {
+	typ reflect.Type // 解码成的类型, nil时和json.Unmarshal()到interface{}一样
+}
+
+//
+// make a JSONCodec that decodes commands into values of example's
+// type. with a nil example, commands decode the way json.Unmarshal()
+// decodes into an interface{} (numbers become float64, &c).
+//
+func MakeJSONCodec(example interface{}) *JSONCodec {
+	return &JSONCodec{typ: reflect.TypeOf(example)}
+}
+
+func (jc *JSONCodec) Encode(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (jc *JSONCodec) Decode(data []byte) (interface{}, error) {
+	if jc.typ == nil {
+		var command interface{}
+		if err := json.Unmarshal(data, &command); err != nil {
+			return nil, err
+		}
+		return command, nil
+	}
+	v := reflect.New(jc.typ)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// passes []byte commands through, behind a 4-byte big-endian length.
+type RawCodec struct{}
+
+func (RawCodec) Encode(command interface{}) ([]byte, error) {
+	b, ok := command.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("raft: RawCodec can't encode a %T, only []byte", command)
+	}
+	data := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(data, uint32(len(b)))
+	return append(data, b...), nil
+}
+
+func (RawCodec) Decode(data []byte) (interface{}, error) {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) != len(data)-4 {
+		return nil, ErrBadRawCommand
+	}
+	return append([]byte{}, data[4:]...), nil
+}
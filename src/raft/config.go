@@ -18,6 +18,17 @@ import "encoding/base64"
 import "sync/atomic"
 import "time"
 import "fmt"
+import "bytes"
+import "encoding/gob"
+import "strings"
+import "path/filepath"
+import "strconv"
+import "errors"
+import "io/ioutil"
+import "net"
+import "os"
+import "os/exec"
+import "context"
 
 func randstring(n int) string {
 	b := make([]byte, 2*n)
@@ -38,12 +49,154 @@ type config struct {
 	saved     []*Persister
 	endnames  [][]string    // the port file names each sends to
 	logs      []map[int]int // copy of each server's committed entries
+	opts      *Options      // passed to MakeWithOptions() for every server; nil to use Make()
+	dir       string        // if set, servers persist under dir instead of to saved[]
+
+	// opens server i's persister in dir/<i>
+	open func(dir string) (Storage, error)
+}
+
+func openFilePersister(dir string) (Storage, error) {
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		return nil, err
+	}
+	return MakePersisterStorage(fp), nil
+}
+
+func openWALPersister(dir string) (Storage, error) {
+	return MakeWALPersister(dir)
+}
+
+// 命令用GobCodec编码的日志项, 测试里直接构造日志时使用
+func commandEntry(term int, command interface{}) Entry {
+	data, err := GobCodec{}.Encode(command)
+	if err != nil {
+		log.Fatalf("encoding command %v: %v\n", command, err)
+	}
+	return Entry{Term: term, Type: EntryCommand, Data: data}
+}
+
+// commandEntry()的逆过程
+func entryCommand(e Entry) interface{} {
+	command, err := GobCodec{}.Decode(e.Data)
+	if err != nil {
+		log.Fatalf("decoding entry %v: %v\n", e, err)
+	}
+	return command
+}
+
+// 最初的persist()保存的状态: gob依次编码currentTerm、votedFor和日志,
+// 日志项是Entry{Term int; Command interface{}}
+func baselineState(term int, votedFor int, log []Entry) []byte {
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(term)
+	e.Encode(votedFor)
+	e.Encode(legacyLog(log))
+	return w.Bytes()
+}
+
+// 把日志转换成命令还没有单独编码时的格式
+func legacyLog(log []Entry) []legacyEntry {
+	old := []legacyEntry{}
+	for _, e := range log {
+		var command interface{} = NoOp{}
+		if c, ok := e.config(); ok {
+			command = c
+		} else if e.Type == EntryCommand {
+			command = entryCommand(e)
+		}
+		old = append(old, legacyEntry{e.Term, command})
+	}
+	return old
+}
+
+var errInjected = errors.New("injected storage failure")
+
+// 包装一个Storage, 可以让读或者写返回errInjected, 模拟磁盘故障
+type faultyStorage struct {
+	Storage
+	failReads  int32
+	failWrites int32
+}
+
+func (fs *faultyStorage) failing(flag *int32) bool {
+	return atomic.LoadInt32(flag) != 0
+}
+
+func (fs *faultyStorage) InitialState() (HardState, SnapshotMeta, error) {
+	if fs.failing(&fs.failReads) {
+		return HardState{}, SnapshotMeta{}, errInjected
+	}
+	return fs.Storage.InitialState()
+}
+
+func (fs *faultyStorage) SetHardState(st HardState) error {
+	if fs.failing(&fs.failWrites) {
+		return errInjected
+	}
+	return fs.Storage.SetHardState(st)
+}
+
+func (fs *faultyStorage) StoreEntries(index int, entries []Entry) error {
+	if fs.failing(&fs.failWrites) {
+		return errInjected
+	}
+	return fs.Storage.StoreEntries(index, entries)
+}
+
+func (fs *faultyStorage) SaveSnapshot(meta SnapshotMeta, snapshot []byte, entries []Entry) error {
+	if fs.failing(&fs.failWrites) {
+		return errInjected
+	}
+	return fs.Storage.SaveSnapshot(meta, snapshot, entries)
 }
 
 var ncpu_once sync.Once
 
+//make_nodes,创建n个互相连接的Node[C]，不支持crash和断开连接，只用来测试带类型的API
+func make_nodes[C any](t *testing.T, n int, opts Options) []*Node[C] {
+	net := labrpc.MakeNetwork()
+	nodes := make([]*Node[C], n)
+	for i := 0; i < n; i++ {
+		ends := make([]*labrpc.ClientEnd, n)
+		for j := 0; j < n; j++ {
+			endname := randstring(20)
+			ends[j] = net.MakeEnd(endname)
+			net.Connect(endname, j)
+			net.Enable(endname, true)
+		}
+		node, err := MakeNode[C](ends, i, MakePersisterStorage(MakePersister()), opts)
+		if err != nil {
+			t.Fatalf("MakeNode(): %v", err)
+		}
+		nodes[i] = node
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(node.Raft()))
+		net.AddServer(i, srv)
+	}
+	return nodes
+}
+
 //make_config,创建N个raft节点的实例，并使他们互相连接
+// 和原来的tester一样用Make()创建raft节点
 func make_config(t *testing.T, n int, unreliable bool) *config {
+	return start_config(t, n, unreliable, nil, "", nil)
+}
+
+//make_config_with,和make_config一样，但所有raft节点(包括重启的)都使用opts
+func make_config_with(t *testing.T, n int, unreliable bool, opts Options) *config {
+	return make_config_on_disk(t, n, unreliable, opts, "", nil)
+}
+
+//make_config_on_disk,和make_config_with一样，但dir不为空时每个raft节点的状态写在open(dir/<i>)打开的persister里
+func make_config_on_disk(t *testing.T, n int, unreliable bool, opts Options, dir string, open func(dir string) (Storage, error)) *config {
+	return start_config(t, n, unreliable, &opts, dir, open)
+}
+
+//start_config,创建并连接所有raft节点，opts为nil时使用Make()
+func start_config(t *testing.T, n int, unreliable bool, opts *Options, dir string, open func(dir string) (Storage, error)) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -52,6 +205,9 @@ func make_config(t *testing.T, n int, unreliable bool) *config {
 	runtime.GOMAXPROCS(4)
 	cfg := &config{}
 	cfg.t = t
+	cfg.opts = opts
+	cfg.dir = dir
+	cfg.open = open
 	cfg.net = labrpc.MakeNetwork()
 	cfg.n = n
 	cfg.applyErr = make([]string, cfg.n) // 节点的请求的返回信息
@@ -105,8 +261,9 @@ func (cfg *config) crash1(i int) {
 
 	if cfg.saved[i] != nil {
 		raftlog := cfg.saved[i].ReadRaftState()
+		snapshot := cfg.saved[i].ReadSnapshot()
 		cfg.saved[i] = &Persister{}
-		cfg.saved[i].SaveRaftState(raftlog)
+		cfg.saved[i].SaveStateAndSnapshot(raftlog, snapshot)
 	}
 }
 
@@ -132,6 +289,7 @@ func (cfg *config) start1(i int) {
 	for j := 0; j < cfg.n; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
 		cfg.net.Connect(cfg.endnames[i][j], j)
+		cfg.net.SetEndOwner(cfg.endnames[i][j], i)
 	}
 
 	cfg.mu.Lock()
@@ -155,8 +313,8 @@ func (cfg *config) start1(i int) {
 		for m := range applyCh {
 			err_msg := ""
 			if m.UseSnapshot {
-				// ignore the snapshot
-			} else if v, ok := (m.Command).(int); ok {
+				err_msg = cfg.applySnapshot(i, m)
+			} else if v, ok := entryValue(m); ok {
 				cfg.mu.Lock()
 				for j := 0; j < len(cfg.logs); j++ {
 					if old, oldok := cfg.logs[j][m.Index]; oldok && old != v {
@@ -188,7 +346,25 @@ func (cfg *config) start1(i int) {
 		}
 	}()
 
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	var rf *Raft
+	if cfg.opts == nil {
+		rf = Make(ends, i, cfg.saved[i], applyCh)
+	} else {
+		storage := MakePersisterStorage(cfg.saved[i])
+		if cfg.dir != "" {
+			// 每次都重新打开目录, 和进程真正重启一样只能看到已经写到磁盘上的状态
+			st, err := cfg.open(filepath.Join(cfg.dir, strconv.Itoa(i)))
+			if err != nil {
+				log.Fatalf("opening persister: %v\n", err)
+			}
+			storage = st
+		}
+		var err error
+		rf, err = MakeWithOptions(ends, i, storage, applyCh, *cfg.opts)
+		if err != nil {
+			log.Fatalf("MakeWithOptions(): %v\n", err)
+		}
+	}
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
@@ -255,6 +431,45 @@ func (cfg *config) disconnect(i int) {
 	}
 }
 
+//
+// split the servers into groups that can only reach each other, on
+// top of connect()/disconnect(). a server may be in several groups,
+// e.g. partition([]int{0, 1, 2}, []int{2, 3, 4}) makes 2 a bridge.
+//
+func (cfg *config) partition(groups ...[]int) {
+	names := [][]interface{}{}
+	for _, group := range groups {
+		g := []interface{}{}
+		for _, i := range group {
+			g = append(g, i)
+		}
+		names = append(names, g)
+	}
+	cfg.net.Partition(names...)
+}
+
+// lose everything server from sends to server to, but not the reverse.
+func (cfg *config) blockLink(from int, to int) {
+	cfg.net.BlockLink(from, to)
+}
+
+// undo partition() and blockLink().
+func (cfg *config) heal() {
+	cfg.net.Heal()
+}
+
+// give the link between servers a and b the faults in p, both ways.
+func (cfg *config) setLinkProfile(a int, b int, p labrpc.LinkProfile) {
+	cfg.net.SetLinkProfile(a, b, p)
+	cfg.net.SetLinkProfile(b, a, p)
+}
+
+// back to the network's global policy on the link between a and b.
+func (cfg *config) clearLinkProfile(a int, b int) {
+	cfg.net.ClearLinkProfile(a, b)
+	cfg.net.ClearLinkProfile(b, a)
+}
+
 func (cfg *config) rpcCount(server int) int {
 	return cfg.net.GetCount(server)
 }
@@ -460,3 +675,514 @@ func (cfg *config) one(cmd int, expectedServers int) int {
 	cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
 	return -1
 }
+
+// build a snapshot of server i's committed entries up to index,
+// in the format applySnapshot() expects.
+func (cfg *config) makeSnapshot(i int, index int) []byte {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	xlog := make([]int, index+1)
+	for j := 1; j <= index; j++ {
+		xlog[j] = cfg.logs[i][j]
+	}
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(index)
+	e.Encode(xlog)
+	return w.Bytes()
+}
+
+// ask server i to snapshot everything it has applied so far.
+// returns the index the snapshot covers.
+func (cfg *config) snapshot(i int) int {
+	cfg.mu.Lock()
+	index := len(cfg.logs[i])
+	rf := cfg.rafts[i]
+	cfg.mu.Unlock()
+	if rf != nil && index > 0 {
+		rf.Snapshot(index, cfg.makeSnapshot(i, index))
+	}
+	return index
+}
+
+// a snapshot arrived on server i's applyCh; replace its
+// committed entries with the snapshot's.
+func (cfg *config) applySnapshot(i int, m ApplyMsg) string {
+	var lastIndex int
+	var xlog []int
+	d := gob.NewDecoder(bytes.NewBuffer(m.Snapshot))
+	if d.Decode(&lastIndex) != nil || d.Decode(&xlog) != nil {
+		return fmt.Sprintf("server %v snapshot decode error", i)
+	}
+	if lastIndex != m.Index {
+		return fmt.Sprintf("server %v snapshot index %v != ApplyMsg index %v", i, lastIndex, m.Index)
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	for j := 1; j <= lastIndex; j++ {
+		for k := 0; k < len(cfg.logs); k++ {
+			if old, oldok := cfg.logs[k][j]; oldok && old != xlog[j] {
+				return fmt.Sprintf("snapshot index=%v server=%v %v != server=%v %v",
+					j, i, xlog[j], k, old)
+			}
+		}
+		cfg.logs[i][j] = xlog[j]
+	}
+	return ""
+}
+
+// the value the tester records for a committed command. membership
+// changes and no-ops occupy a log index too, so they are recorded as
+// -1 to keep the in-order and agreement checks working.
+func entryValue(m ApplyMsg) (int, bool) {
+	if m.Internal {
+		return -1, true
+	}
+	v, ok := m.Command.(int)
+	return v, ok
+}
+
+// ask the leader to switch the cluster to the given voting servers,
+// and wait until it reports the new configuration as committed.
+func (cfg *config) changeConfig(servers []int) {
+	cfg.reconfigure(fmt.Sprintf("changeConfig(%v)", servers),
+		func(rf *Raft) bool {
+			_, _, ok := rf.ChangeConfig(servers)
+			return ok
+		},
+		func(c Configuration) bool {
+			return !c.isJoint() && fmt.Sprint(c.Servers) == fmt.Sprint(servers)
+		})
+}
+
+// ask the leader to add server as a learner, and wait until that
+// configuration is committed.
+func (cfg *config) addLearner(server int) {
+	cfg.reconfigure(fmt.Sprintf("addLearner(%v)", server),
+		func(rf *Raft) bool {
+			_, _, ok := rf.AddLearner(server)
+			return ok
+		},
+		func(c Configuration) bool {
+			return c.isLearner(server)
+		})
+}
+
+// ask the leader to promote a learner, and wait until it is a voter in
+// a committed, non-joint configuration.
+func (cfg *config) promoteLearner(server int) {
+	cfg.reconfigure(fmt.Sprintf("promoteLearner(%v)", server),
+		func(rf *Raft) bool {
+			_, _, ok := rf.PromoteLearner(server)
+			return ok
+		},
+		func(c Configuration) bool {
+			return !c.isJoint() && c.isVoter(server) && !c.isLearner(server)
+		})
+}
+
+// try a configuration change on each connected server until one
+// accepts it, then wait until done() holds for its committed
+// configuration.
+func (cfg *config) reconfigure(what string, try func(rf *Raft) bool, done func(c Configuration) bool) {
+	t0 := time.Now()
+	for time.Since(t0).Seconds() < 10 {
+		for i := 0; i < cfg.n; i++ {
+			var rf *Raft
+			cfg.mu.Lock()
+			if cfg.connected[i] {
+				rf = cfg.rafts[i]
+			}
+			cfg.mu.Unlock()
+			if rf == nil {
+				continue
+			}
+			if try(rf) {
+				t1 := time.Now()
+				for time.Since(t1).Seconds() < 2 {
+					c, committed := rf.GetConfiguration()
+					if committed && done(c) {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cfg.t.Fatalf("%v failed to commit", what)
+}
+
+// the stacks of the goroutines Raft started that are still running.
+// handlers that labrpc is running for other servers' requests don't
+// count: they belong to the network, not to the Raft they call.
+func raftGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	left := []string{}
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "raft.(*Raft).") && !strings.Contains(g, "labrpc.(*Server).dispatch") {
+			left = append(left, g)
+		}
+	}
+	return left
+}
+
+//
+// a cluster of Raft servers in separate processes, talking over
+// TCP on localhost. each process is this test binary running
+// TestTCPPeerProcess, which calls runTCPPeer().
+//
+type tcpCluster struct {
+	t     *testing.T
+	dir   string
+	addrs []string
+	procs []*exec.Cmd
+	ends  []*labrpc.ClientEnd // to each process's tcpPeer
+}
+
+// the tester's view of a Raft server in another process
+type tcpPeer struct {
+	mu      sync.Mutex
+	rf      *Raft
+	applied map[int]int // index -> committed command
+}
+
+type TCPStartReply struct {
+	Index    int
+	Term     int
+	IsLeader bool
+}
+
+func (p *tcpPeer) Start(command int, reply *TCPStartReply) {
+	reply.Index, reply.Term, reply.IsLeader = p.rf.Start(command)
+}
+
+// the command applied at index, or 0 if none has been yet
+func (p *tcpPeer) Applied(index int, reply *int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*reply = p.applied[index]
+}
+
+//
+// run server me of the cluster at addrs, persisting to dir, until the
+// process is killed or its stdin is closed (i.e. the tester exited).
+// the Raft is built by Make() exactly as a service would, with TCP
+// ClientEnds instead of a labrpc.Network.
+//
+func runTCPPeer(addrs []string, me int, dir string) {
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		log.Fatalf("opening persister: %v\n", err)
+	}
+	ends := make([]*labrpc.ClientEnd, len(addrs))
+	for i, addr := range addrs {
+		ends[i] = labrpc.MakeTCPEnd(addr, time.Second)
+	}
+	applyCh := make(chan ApplyMsg)
+	rf, err := MakeWithOptions(ends, me, MakePersisterStorage(fp), applyCh, DefaultOptions())
+	if err != nil {
+		log.Fatalf("MakeWithOptions(): %v\n", err)
+	}
+	p := &tcpPeer{rf: rf, applied: map[int]int{}}
+	go func() {
+		for m := range applyCh {
+			if v, ok := entryValue(m); ok && !m.Internal {
+				p.mu.Lock()
+				p.applied[m.Index] = v
+				p.mu.Unlock()
+			}
+		}
+	}()
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(p.rf))
+	srv.AddService(labrpc.MakeService(p))
+	if _, err := labrpc.ServeTCP(srv, addrs[me]); err != nil {
+		log.Fatalf("ServeTCP(): %v\n", err)
+	}
+	ioutil.ReadAll(os.Stdin)
+	os.Exit(0)
+}
+
+func make_tcp_cluster(t *testing.T, n int) *tcpCluster {
+	tc := &tcpCluster{t: t}
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	tc.dir = dir
+	tc.procs = make([]*exec.Cmd, n)
+	tc.ends = make([]*labrpc.ClientEnd, n)
+	// 先占用再释放一个端口, 子进程马上就会重新监听它
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		tc.addrs = append(tc.addrs, ln.Addr().String())
+		ln.Close()
+	}
+	for i := 0; i < n; i++ {
+		tc.ends[i] = labrpc.MakeTCPEnd(tc.addrs[i], time.Second)
+		tc.start1(i)
+	}
+	return tc
+}
+
+// start server i's process, which resumes from its persisted state
+func (tc *tcpCluster) start1(i int) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTCPPeerProcess$")
+	cmd.Env = append(os.Environ(),
+		"RAFT_TCP_PEERS="+strings.Join(tc.addrs, ","),
+		"RAFT_TCP_ME="+strconv.Itoa(i),
+		"RAFT_TCP_DIR="+filepath.Join(tc.dir, strconv.Itoa(i)))
+	cmd.Stderr = os.Stderr
+	// 测试进程退出时管道被关闭, 子进程随之退出; cmd持有管道直到Wait()
+	if _, err := cmd.StdinPipe(); err != nil {
+		tc.t.Fatalf("starting server %v: %v", i, err)
+	}
+	if err := cmd.Start(); err != nil {
+		tc.t.Fatalf("starting server %v: %v", i, err)
+	}
+	tc.procs[i] = cmd
+}
+
+// kill server i's process
+func (tc *tcpCluster) crash1(i int) {
+	if tc.procs[i] != nil {
+		tc.procs[i].Process.Kill()
+		tc.procs[i].Wait()
+		tc.procs[i] = nil
+	}
+}
+
+func (tc *tcpCluster) cleanup() {
+	for i := range tc.procs {
+		tc.crash1(i)
+	}
+	os.RemoveAll(tc.dir)
+}
+
+// like config.one(): commit cmd and wait until all of servers applied it
+func (tc *tcpCluster) one(cmd int, servers []int) int {
+	t0 := time.Now()
+	for time.Since(t0) < 10*time.Second {
+		for _, i := range servers {
+			reply := TCPStartReply{}
+			if !tc.ends[i].Call("tcpPeer.Start", cmd, &reply) || !reply.IsLeader {
+				continue
+			}
+			for t1 := time.Now(); time.Since(t1) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+				n := 0
+				for _, j := range servers {
+					v := 0
+					if tc.ends[j].Call("tcpPeer.Applied", reply.Index, &v) && v == cmd {
+						n++
+					}
+				}
+				if n == len(servers) {
+					return reply.Index
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	tc.t.Fatalf("one(%v) failed to reach agreement", cmd)
+	return -1
+}
+
+//
+// Raft servers that reach each other through Transports that call the
+// other server's handlers directly, the way a service with its own RPC
+// stack would use MakeWithTransport(). labrpc isn't involved at all.
+//
+type directNet struct {
+	t       *testing.T
+	mu      sync.Mutex
+	rafts   []*Raft
+	cut     []bool        // 被隔离的server, 不能发送也不能接收RPC
+	lost    []bool        // 发给这些server或者由它们发出的RPC有去无回, 一直等到调用方放弃
+	pending int32         // 正在等待调用方放弃的RPC数量
+	slow    time.Duration // 每个回复都要晚这么久才送到, 不理会调用方是否已经放弃
+	applied []map[int]int // server -> index -> committed command
+}
+
+// from调用to的handler
+type directTransport struct {
+	dn   *directNet
+	from int
+	to   int
+}
+
+func make_direct_net(t *testing.T, n int) *directNet {
+	dn := &directNet{t: t}
+	dn.rafts = make([]*Raft, n)
+	dn.cut = make([]bool, n)
+	dn.lost = make([]bool, n)
+	dn.applied = make([]map[int]int, n)
+	for i := 0; i < n; i++ {
+		peers := make([]Transport, n)
+		for j := 0; j < n; j++ {
+			if j != i {
+				peers[j] = &directTransport{dn, i, j}
+			}
+		}
+		applyCh := make(chan ApplyMsg)
+		rf, err := MakeWithTransport(peers, i, MakePersisterStorage(MakePersister()), applyCh, DefaultOptions())
+		if err != nil {
+			t.Fatalf("MakeWithTransport(): %v", err)
+		}
+		dn.mu.Lock()
+		dn.rafts[i] = rf
+		dn.applied[i] = map[int]int{}
+		dn.mu.Unlock()
+		go func(i int) {
+			for m := range applyCh {
+				if v, ok := entryValue(m); ok && !m.Internal {
+					dn.mu.Lock()
+					dn.applied[i][m.Index] = v
+					dn.mu.Unlock()
+				}
+			}
+		}(i)
+	}
+	return dn
+}
+
+// cut server i off from the others, or connect it again
+func (dn *directNet) isolate(i int, cut bool) {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	dn.cut[i] = cut
+}
+
+func (dn *directNet) cleanup() {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	for _, rf := range dn.rafts {
+		rf.Kill()
+	}
+}
+
+// like config.one(): commit cmd and wait until all of servers applied it
+func (dn *directNet) one(cmd int, servers []int) int {
+	t0 := time.Now()
+	for time.Since(t0) < 10*time.Second {
+		for _, i := range servers {
+			dn.mu.Lock()
+			rf := dn.rafts[i]
+			dn.mu.Unlock()
+			index, _, isLeader := rf.Start(cmd)
+			if !isLeader {
+				continue
+			}
+			for t1 := time.Now(); time.Since(t1) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+				n := 0
+				dn.mu.Lock()
+				for _, j := range servers {
+					if dn.applied[j][index] == cmd {
+						n++
+					}
+				}
+				dn.mu.Unlock()
+				if n == len(servers) {
+					return index
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	dn.t.Fatalf("one(%v) failed to reach agreement", cmd)
+	return -1
+}
+
+// make RPCs to or from server i hang until the caller gives up
+func (dn *directNet) loseReplies(i int) {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	dn.lost[i] = true
+}
+
+// deliver every reply d late, even to callers that gave up
+func (dn *directNet) slowReplies(d time.Duration) {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	dn.slow = d
+}
+
+// number of RPCs still waiting for their caller to give up
+func (dn *directNet) pendingRPCs() int {
+	return int(atomic.LoadInt32(&dn.pending))
+}
+
+// the Raft to deliver an RPC to, or nil if it can't be reached;
+// lost is true if the RPC should never get a reply
+func (dt *directTransport) target() (rf *Raft, lost bool) {
+	dt.dn.mu.Lock()
+	defer dt.dn.mu.Unlock()
+	if dt.dn.lost[dt.from] || dt.dn.lost[dt.to] {
+		return nil, true
+	}
+	if dt.dn.cut[dt.from] || dt.dn.cut[dt.to] {
+		return nil, false
+	}
+	return dt.dn.rafts[dt.to], false
+}
+
+//
+// call handler on the target with copies of args and reply, so that,
+// as over a real network, the two servers share no memory.
+//
+func directCall[A any, R any](ctx context.Context, dt *directTransport, args *A, reply *R, handler func(*Raft, *A, *R)) bool {
+	rf, lost := dt.target()
+	if lost {
+		atomic.AddInt32(&dt.dn.pending, 1)
+		defer atomic.AddInt32(&dt.dn.pending, -1)
+		<-ctx.Done()
+		return false
+	}
+	if rf == nil {
+		return false
+	}
+	var a A
+	var r R
+	gobCopy(args, &a)
+	handler(rf, &a, &r)
+	dt.dn.mu.Lock()
+	slow := dt.dn.slow
+	dt.dn.mu.Unlock()
+	time.Sleep(slow)
+	gobCopy(&r, reply)
+	return true
+}
+
+func gobCopy(src interface{}, dst interface{}) {
+	w := new(bytes.Buffer)
+	if err := gob.NewEncoder(w).Encode(src); err != nil {
+		panic(err)
+	}
+	if err := gob.NewDecoder(w).Decode(dst); err != nil {
+		panic(err)
+	}
+}
+
+func (dt *directTransport) RequestVote(ctx context.Context, args *RequestVoteArgs, reply *RequestVoteReply) bool {
+	return directCall(ctx, dt, args, reply, (*Raft).RequestVote)
+}
+
+func (dt *directTransport) AppendEntries(ctx context.Context, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	return directCall(ctx, dt, args, reply, (*Raft).AppendEntries)
+}
+
+func (dt *directTransport) InstallSnapshot(ctx context.Context, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
+	return directCall(ctx, dt, args, reply, (*Raft).InstallSnapshot)
+}
+
+func (dt *directTransport) TimeoutNow(ctx context.Context, args *TimeoutNowArgs, reply *TimeoutNowReply) bool {
+	return directCall(ctx, dt, args, reply, (*Raft).TimeoutNow)
+}
+
+func (dt *directTransport) ForwardProposal(ctx context.Context, args *ForwardProposalArgs, reply *ForwardProposalReply) bool {
+	return directCall(ctx, dt, args, reply, (*Raft).ForwardProposal)
+}
@@ -0,0 +1,213 @@
+package raft
+
+//
+// 写到磁盘上的Persister, 进程真正重启之后也能恢复.
+//
+// 每次保存都先写临时文件、fsync, 再rename覆盖原文件并fsync目录,
+// 所以任何时候crash, 磁盘上的文件要么是旧的完整版本, 要么是新的完整版本.
+//
+// raft状态和快照必须一起生效(见persistWithSnapshot), 两次rename做不到原子,
+// 所以快照文件带一个递增的版本号(snapshot-<gen>), raft状态文件里记录它对应的
+// 快照版本: 先写新版本的快照, 再写引用它的状态文件, 状态文件rename成功的
+// 那一刻才算保存完成. crash留下的新快照没有被状态文件引用, 下次打开时删除.
+// 状态文件是一条带校验的记录(见format.go), 损坏时MakeFilePersister()返回错误.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	stateFileName  = "raftstate"
+	snapshotPrefix = "snapshot-"
+	tempSuffix     = ".tmp"
+)
+
+type FilePersister struct {
+	mu        sync.Mutex
+	dir       string
+	gen       uint64 // 当前快照的版本号, 0表示还没有快照
+	raftstate []byte // 磁盘上内容的缓存, 读的时候不用访问磁盘
+	snapshot  []byte
+}
+
+//
+// open (creating it if needed) a FilePersister that keeps its files
+// in dir, and load whatever an earlier FilePersister saved there.
+// only one FilePersister may use a directory at a time. the Save
+// methods panic if a write fails, since Raft can't safely carry on
+// without its state.
+//
+func MakeFilePersister(dir string) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fp := &FilePersister{dir: dir}
+	if err := fp.load(); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// 读入状态文件和它引用的快照, 删掉crash留下的临时文件和没有被引用的快照
+func (fp *FilePersister) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(fp.dir, stateFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if data, err = readWholeRecord(data); err != nil || len(data) < 8 {
+			return ErrCorruptState
+		}
+		fp.gen = binary.BigEndian.Uint64(data[:8])
+		fp.raftstate = data[8:]
+		if fp.gen != 0 {
+			fp.snapshot, err = ioutil.ReadFile(fp.snapshotPath(fp.gen))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	names, err := ioutil.ReadDir(fp.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range names {
+		name := fi.Name()
+		stale := strings.HasSuffix(name, tempSuffix)
+		if strings.HasPrefix(name, snapshotPrefix) && !stale {
+			gen, err := strconv.ParseUint(strings.TrimPrefix(name, snapshotPrefix), 10, 64)
+			stale = err == nil && gen != fp.gen
+		}
+		if stale {
+			os.Remove(filepath.Join(fp.dir, name))
+		}
+	}
+	return nil
+}
+
+func (fp *FilePersister) snapshotPath(gen uint64) string {
+	return filepath.Join(fp.dir, snapshotPrefix+strconv.FormatUint(gen, 10))
+}
+
+// 先写临时文件并fsync, 再rename覆盖path, 最后fsync目录让rename本身落盘
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + tempSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// 写状态文件, 调用时需要持有fp.mu
+func (fp *FilePersister) writeState(gen uint64, state []byte) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, gen)
+	buf.Write(state)
+	if err := writeFileAtomic(filepath.Join(fp.dir, stateFileName), frameRecord(buf.Bytes())); err != nil {
+		panic(fmt.Sprintf("raft: couldn't save state in %v: %v", fp.dir, err))
+	}
+}
+
+// 写新版本的快照和引用它的状态文件, 再删掉旧快照, 调用时需要持有fp.mu
+func (fp *FilePersister) writeStateAndSnapshot(state []byte, snapshot []byte) {
+	gen := fp.gen + 1
+	if err := writeFileAtomic(fp.snapshotPath(gen), snapshot); err != nil {
+		panic(fmt.Sprintf("raft: couldn't save snapshot in %v: %v", fp.dir, err))
+	}
+	fp.writeState(gen, state)
+	if fp.gen != 0 {
+		os.Remove(fp.snapshotPath(fp.gen))
+	}
+	fp.gen = gen
+}
+
+//
+// open another FilePersister on the same directory, as a restarted
+// process would. the old one must not be used afterwards.
+//
+func (fp *FilePersister) Copy() *FilePersister {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return &FilePersister{dir: fp.dir, gen: fp.gen, raftstate: fp.raftstate, snapshot: fp.snapshot}
+}
+
+func (fp *FilePersister) SaveRaftState(data []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.writeState(fp.gen, data)
+	fp.raftstate = data
+}
+
+func (fp *FilePersister) ReadRaftState() []byte {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.raftstate
+}
+
+func (fp *FilePersister) RaftStateSize() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return len(fp.raftstate)
+}
+
+func (fp *FilePersister) SaveSnapshot(snapshot []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.writeStateAndSnapshot(fp.raftstate, snapshot)
+	fp.snapshot = snapshot
+}
+
+func (fp *FilePersister) ReadSnapshot() []byte {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.snapshot
+}
+
+func (fp *FilePersister) SnapshotSize() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return len(fp.snapshot)
+}
+
+// save both Raft state and snapshot as a single atomic action:
+// after a crash, either both or neither are replaced.
+func (fp *FilePersister) SaveStateAndSnapshot(state []byte, snapshot []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.writeStateAndSnapshot(state, snapshot)
+	fp.raftstate = state
+	fp.snapshot = snapshot
+}
@@ -0,0 +1,208 @@
+package raft
+
+//
+// 持久化数据的格式.
+//
+// raft状态(encodePersistentState()的结果)以5字节的magic "\x00raft"和1字节的版本号开头,
+// 后面是一条带校验的记录, 内容是gob编码的persistentState.
+// 带校验的记录: 4字节的长度, 4字节的CRC32(Castagnoli), 然后是数据本身.
+// WAL里的每条记录、WAL的meta和FilePersister的状态文件也都是这样的记录.
+//
+// 版本2的日志项只保存编码之后的命令(见codec.go). 版本1和更早的格式里
+// 日志项的命令是gob编码的接口值(legacyEntry), 读出来之后用GobCodec转换.
+// 最早的格式没有头部, 直接用gob依次编码各个字段: 最初只有currentTerm、votedFor
+// 和日志, 加上快照之后又多了lastIncludedIndex、lastIncludedTerm和快照的配置.
+// gob数据的第一个字节是第一条消息的长度, 不会是0, 所以不以magic开头的数据
+// 就按这两种格式解码.
+// MakePersisterStorage()读到旧格式的状态之后马上按新格式重新保存一次.
+//
+// 解码时任何错误(校验和不对、数据被截断、不认识的版本)都会返回错误,
+// 而不是当作没有状态从任期0开始, 那样可能投出第二张票或者丢掉已经提交的日志.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+)
+
+const stateVersion = 2
+
+var stateMagic = []byte("\x00raft")
+
+var (
+	ErrCorruptState       = errors.New("raft: persisted state is corrupt")
+	ErrUnsupportedVersion = errors.New("raft: persisted state has an unsupported format version")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// raft需要持久化的全部状态
+type persistentState struct {
+	Term              int
+	VotedFor          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	SnapshotConfig    Configuration
+	Log               []Entry
+}
+
+// 版本1的状态, 和persistentState只差在日志项的格式
+type persistentStateV1 struct {
+	Term              int
+	VotedFor          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	SnapshotConfig    Configuration
+	Log               []legacyEntry
+}
+
+// 命令还没有单独编码时的日志项
+type legacyEntry struct {
+	Term    int
+	Command interface{}
+}
+
+// 旧的命令以前就是和整个状态一起用gob编码的, 所以用GobCodec转换
+func convertLegacyEntries(old []legacyEntry) ([]Entry, error) {
+	log := make([]Entry, 0, len(old))
+	for _, e := range old {
+		switch c := e.Command.(type) {
+		case NoOp:
+			log = append(log, Entry{Term: e.Term, Type: EntryNoOp})
+		case Configuration:
+			log = append(log, configEntry(e.Term, c))
+		default:
+			data, err := GobCodec{}.Encode(e.Command)
+			if err != nil {
+				return nil, err
+			}
+			log = append(log, Entry{Term: e.Term, Type: EntryCommand, Data: data})
+		}
+	}
+	return log, nil
+}
+
+// 把data包装成一条带校验的记录
+func frameRecord(data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(data, crcTable))
+	return append(buf, data...)
+}
+
+//
+// 读出buf开头的一条带校验的记录, 返回记录里的数据和整条记录占用的字节数.
+// 记录不完整时n为0; 校验和不对时返回ErrCorruptState, n仍然是记录的长度
+//
+func readRecord(buf []byte) ([]byte, int, error) {
+	if len(buf) < 8 {
+		return nil, 0, nil
+	}
+	size := int(binary.BigEndian.Uint32(buf[:4]))
+	if len(buf)-8 < size {
+		return nil, 0, nil
+	}
+	data := buf[8 : 8+size]
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, 8 + size, ErrCorruptState
+	}
+	return data, 8 + size, nil
+}
+
+// 整个buf是一条完整的带校验的记录
+func readWholeRecord(buf []byte) ([]byte, error) {
+	data, n, err := readRecord(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n != len(buf) {
+		return nil, ErrCorruptState
+	}
+	return data, nil
+}
+
+func encodePersistentState(ps persistentState) []byte {
+	w := new(bytes.Buffer)
+	gob.NewEncoder(w).Encode(ps)
+	buf := append([]byte{}, stateMagic...)
+	buf = append(buf, stateVersion)
+	return append(buf, frameRecord(w.Bytes())...)
+}
+
+//
+// encodePersistentState()的逆过程, 也能读旧格式, 这时legacy为true.
+// data不能为空
+//
+func decodePersistentState(data []byte) (ps persistentState, legacy bool, err error) {
+	if !bytes.HasPrefix(data, stateMagic) {
+		ps, err = decodeLegacyState(data)
+		return ps, true, err
+	}
+	data = data[len(stateMagic):]
+	if len(data) < 1 {
+		return ps, false, ErrCorruptState
+	}
+	version := data[0]
+	if version != stateVersion && version != 1 {
+		return ps, false, ErrUnsupportedVersion
+	}
+	body, err := readWholeRecord(data[1:])
+	if err != nil {
+		return ps, false, err
+	}
+	if version == 1 {
+		var v1 persistentStateV1
+		if gob.NewDecoder(bytes.NewReader(body)).Decode(&v1) != nil {
+			return ps, true, ErrCorruptState
+		}
+		ps = persistentState{v1.Term, v1.VotedFor, v1.LastIncludedIndex, v1.LastIncludedTerm, v1.SnapshotConfig, nil}
+		if ps.Log, err = convertLegacyEntries(v1.Log); err != nil {
+			return ps, true, ErrCorruptState
+		}
+		return ps, true, nil
+	}
+	if gob.NewDecoder(bytes.NewReader(body)).Decode(&ps) != nil {
+		return ps, false, ErrCorruptState
+	}
+	return ps, false, nil
+}
+
+// 没有头部的旧格式: 先按有快照字段的格式解码, 不行再按只有term、votedFor和日志的格式
+func decodeLegacyState(data []byte) (persistentState, error) {
+	ps, log, ok := decodeLegacyFields(data, true)
+	if !ok {
+		// 没有快照: lastIncludedIndex和lastIncludedTerm都是0, 配置是初始配置
+		ps, log, ok = decodeLegacyFields(data, false)
+	}
+	if !ok {
+		return ps, ErrCorruptState
+	}
+	var err error
+	if ps.Log, err = convertLegacyEntries(log); err != nil {
+		return ps, ErrCorruptState
+	}
+	return ps, nil
+}
+
+// 用gob依次解码各个字段, 每个字段都必须存在, 而且不能有多余的数据
+func decodeLegacyFields(data []byte, snapshot bool) (persistentState, []legacyEntry, bool) {
+	var ps persistentState
+	var log []legacyEntry
+	r := bytes.NewBuffer(data)
+	d := gob.NewDecoder(r)
+	if d.Decode(&ps.Term) != nil || d.Decode(&ps.VotedFor) != nil {
+		return ps, nil, false
+	}
+	if snapshot && (d.Decode(&ps.LastIncludedIndex) != nil ||
+		d.Decode(&ps.LastIncludedTerm) != nil ||
+		d.Decode(&ps.SnapshotConfig) != nil) {
+		return ps, nil, false
+	}
+	if d.Decode(&log) != nil || r.Len() != 0 {
+		return ps, nil, false
+	}
+	return ps, log, true
+}
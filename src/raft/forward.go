@@ -0,0 +1,63 @@
+package raft
+
+//
+// follower把Start()的命令转发给leader.
+//
+// follower从AppendEntries/InstallSnapshot中知道当前任期的leader(rf.leaderId),
+// 开启Options.ForwardProposals之后, follower的Start()通过ForwardProposal RPC
+// 让leader追加这条命令, 并把leader给出的索引和任期号返回给service.
+// 只转发一次: 收到转发的server自己不是leader时直接拒绝, 不会再往下转发,
+// 避免在leader变化期间来回转发.
+//
+
+type ForwardProposalArgs struct {
+	// 转发者的任期号
+	Term int
+	// 转发者的id
+	FollowerId int
+	// 要追加的命令, 已经用Options.Codec编码
+	Command []byte
+}
+
+type ForwardProposalReply struct {
+	// leader给出的索引和任期号
+	Index int
+	Term  int
+	// 收到转发的server是不是leader, 是否接受了这条命令
+	IsLeader bool
+}
+
+// leader收到follower转发来的命令, 和Start()一样追加到日志里
+func (rf *Raft) ForwardProposal(args *ForwardProposalArgs, reply *ForwardProposalReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	DPrintf("Server %d: got ForwardProposal from server %d, args: %+v, current term: %d\n", rf.me, args.FollowerId, args, rf.currentTerm)
+	reply.Index = -1
+	reply.Term = rf.currentTerm
+	// 转发者已经进入了更新的任期, 自己很可能不再是leader了
+	if args.Term > rf.currentTerm {
+		return
+	}
+	reply.Index, reply.Term, reply.IsLeader = rf.start(args.Command)
+}
+
+func (rf *Raft) sendForwardProposal(server int, args *ForwardProposalArgs, reply *ForwardProposalReply) bool {
+	ok := rf.peer(server).ForwardProposal(rf.ctx, args, reply)
+	// Kill()之后当作没有收到回复
+	return ok && !rf.killed()
+}
+
+// 把命令转发给leader, 返回值和Start()相同; 联系不上leader时返回false
+func (rf *Raft) forwardProposal(leader int, term int, command []byte) (int, int, bool) {
+	args := ForwardProposalArgs{
+		Term:       term,
+		FollowerId: rf.me,
+		Command:    command,
+	}
+	reply := ForwardProposalReply{}
+	if !rf.sendForwardProposal(leader, &args, &reply) {
+		DPrintf("Server %d: couldn't forward a %d-byte command to leader %d\n", rf.me, len(command), leader)
+		return -1, term, false
+	}
+	return reply.Index, reply.Term, reply.IsLeader
+}
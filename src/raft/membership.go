@@ -0,0 +1,392 @@
+package raft
+
+//
+// 集群成员变更, 采用论文第6节的联合共识(joint consensus).
+//
+// 配置作为一条EntryConfig类型的日志项在集群中复制, 每个server
+// 一旦把配置写进自己的日志就立即使用它, 不需要等到提交.
+// 从C_old切换到C_new分两步: leader先追加联合配置C_old,new, 它提交之后
+// 再追加C_new. 联合配置生效期间, 选举和提交都需要同时得到C_old和C_new
+// 各自的多数派, 因此任何时刻都不会出现两个独立做决定的多数派.
+//
+// learner是没有投票权的成员(只读副本、热备): leader照常给它们复制日志,
+// 但它们不计入任何多数派, 也不会发起选举. 增删learner不影响多数派,
+// 所以只需要一步; 把learner提升为voter和普通的成员变更一样走联合共识.
+//
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"labrpc"
+	"sort"
+)
+
+type Configuration struct {
+	Servers    []int // C_new, 非联合状态下就是当前的全部成员
+	OldServers []int // C_old, 只在联合共识期间不为空
+	Learners   []int // 没有投票权的learner, 和Servers/OldServers不相交
+}
+
+func init() {
+	// 旧格式的日志里配置是Command字段中的接口值, 见legacyEntry
+	gob.Register(Configuration{})
+}
+
+// 配置在日志里用JSON编码, 和service使用的Codec无关
+func encodeConfiguration(c Configuration) []byte {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(fmt.Sprintf("raft: can't encode configuration %v: %v", c, err))
+	}
+	return data
+}
+
+func decodeConfiguration(data []byte) Configuration {
+	var c Configuration
+	if err := json.Unmarshal(data, &c); err != nil {
+		panic(fmt.Sprintf("raft: can't decode configuration %q: %v", data, err))
+	}
+	return c
+}
+
+func (c Configuration) isJoint() bool {
+	return len(c.OldServers) > 0
+}
+
+// C_old和C_new的并集, 按id排序
+func (c Configuration) members() []int {
+	seen := map[int]bool{}
+	members := []int{}
+	for _, servers := range [][]int{c.Servers, c.OldServers} {
+		for _, server := range servers {
+			if !seen[server] {
+				seen[server] = true
+				members = append(members, server)
+			}
+		}
+	}
+	sort.Ints(members)
+	return members
+}
+
+// server是否有投票权(可以参与选举并计入多数派)
+func (c Configuration) isVoter(server int) bool {
+	return containsServer(c.Servers, server) || containsServer(c.OldServers, server)
+}
+
+func (c Configuration) isLearner(server int) bool {
+	return containsServer(c.Learners, server)
+}
+
+// 需要复制日志的全部成员: voter加上learner, 按id排序
+func (c Configuration) replicas() []int {
+	replicas := c.members()
+	for _, server := range c.Learners {
+		if !containsServer(replicas, server) {
+			replicas = append(replicas, server)
+		}
+	}
+	sort.Ints(replicas)
+	return replicas
+}
+
+// ok为true的server是否构成多数派, 联合共识期间C_old和C_new都要满足
+func (c Configuration) quorum(ok func(server int) bool) bool {
+	if !isMajority(c.Servers, ok) {
+		return false
+	}
+	if c.isJoint() && !isMajority(c.OldServers, ok) {
+		return false
+	}
+	return true
+}
+
+// 最大的N, 使得(每一组配置的)多数派都已经复制到了N
+func (c Configuration) quorumIndex(match func(server int) int) int {
+	N := quorumMatchIndex(c.Servers, match)
+	if c.isJoint() {
+		if old := quorumMatchIndex(c.OldServers, match); old < N {
+			N = old
+		}
+	}
+	return N
+}
+
+func isMajority(servers []int, ok func(server int) bool) bool {
+	n := 0
+	for _, server := range servers {
+		if ok(server) {
+			n++
+		}
+	}
+	return n > len(servers)/2
+}
+
+// paper中Figure 8的情形: 把各个server的matchIndex排序, 取多数派都已经达到的那个值
+func quorumMatchIndex(servers []int, match func(server int) int) int {
+	if len(servers) == 0 {
+		return 0
+	}
+	matchIndex := make([]int, len(servers))
+	for i, server := range servers {
+		matchIndex[i] = match(server)
+	}
+	sort.Ints(matchIndex)
+	return matchIndex[(len(matchIndex)-1)/2]
+}
+
+func containsServer(servers []int, server int) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// ask the leader to switch the cluster to the given set of voting
+// servers. the change goes through a joint configuration first, so
+// it is not finished until GetConfiguration() reports the new set as
+// committed. learners in servers become voters, other learners stay
+// learners. returns false if this server isn't the leader, another
+// change is still in progress, or a server has no known RPC end point
+// (see AddPeer()).
+//
+func (rf *Raft) ChangeConfig(servers []int) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != Leader || len(servers) == 0 {
+		return -1, rf.currentTerm, false
+	}
+	// 同一时间只允许一个配置变更, 上一个配置还没提交时拒绝新的变更
+	if rf.config.isJoint() || rf.configIndex > rf.commitIndex {
+		return -1, rf.currentTerm, false
+	}
+	newServers := []int{}
+	for _, server := range servers {
+		if server < 0 || server >= len(rf.peers) || rf.peers[server] == nil {
+			return -1, rf.currentTerm, false
+		}
+		if !containsServer(newServers, server) {
+			newServers = append(newServers, server)
+		}
+	}
+	sort.Ints(newServers)
+	// 被加入voter的learner不再是learner
+	learners := []int{}
+	for _, server := range rf.config.Learners {
+		if !containsServer(newServers, server) {
+			learners = append(learners, server)
+		}
+	}
+	DPrintf("Leader %d: change configuration from %v to %v\n", rf.me, rf.config.Servers, newServers)
+	rf.appendLog(configEntry(rf.currentTerm, Configuration{Servers: newServers, OldServers: rf.config.Servers, Learners: learners}))
+	rf.persist()
+	return rf.configIndex, rf.currentTerm, true
+}
+
+// add server to the voting members. see ChangeConfig().
+func (rf *Raft) AddServer(server int) (int, int, bool) {
+	rf.mu.Lock()
+	servers := append([]int{server}, rf.config.Servers...)
+	rf.mu.Unlock()
+	return rf.ChangeConfig(servers)
+}
+
+// remove server from the voting members. see ChangeConfig().
+func (rf *Raft) RemoveServer(server int) (int, int, bool) {
+	rf.mu.Lock()
+	servers := []int{}
+	for _, s := range rf.config.Servers {
+		if s != server {
+			servers = append(servers, s)
+		}
+	}
+	rf.mu.Unlock()
+	return rf.ChangeConfig(servers)
+}
+
+//
+// ask the leader to add server as a learner: it receives the log like
+// any other member, but doesn't vote and never starts elections. the
+// change takes a single configuration entry. returns false in the same
+// cases as ChangeConfig(), or if server is already a member.
+//
+func (rf *Raft) AddLearner(server int) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.config.isVoter(server) || rf.config.isLearner(server) {
+		return -1, rf.currentTerm, false
+	}
+	return rf.changeLearners(append([]int{server}, rf.config.Learners...))
+}
+
+// remove a learner from the cluster. see AddLearner().
+func (rf *Raft) RemoveLearner(server int) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if !rf.config.isLearner(server) {
+		return -1, rf.currentTerm, false
+	}
+	learners := []int{}
+	for _, s := range rf.config.Learners {
+		if s != server {
+			learners = append(learners, s)
+		}
+	}
+	return rf.changeLearners(learners)
+}
+
+//
+// make a learner a voter, once its log is within
+// Options.MaxPromotionLag entries of the leader's. like AddServer(),
+// the change goes through a joint configuration. returns false if
+// server isn't a learner or is still catching up, or in the same
+// cases as ChangeConfig().
+//
+func (rf *Raft) PromoteLearner(server int) (int, int, bool) {
+	rf.mu.Lock()
+	if rf.state != Leader || !rf.config.isLearner(server) {
+		rf.mu.Unlock()
+		return -1, rf.currentTerm, false
+	}
+	// learner还在追赶日志, 现在提升的话新配置可能要等它追上才能提交
+	if rf.getLastLogIndex()-rf.matchIndex[server] > rf.opts.MaxPromotionLag {
+		DPrintf("Leader %d: learner %d is too far behind to promote, matchIndex: %d, last log index: %d\n", rf.me, server, rf.matchIndex[server], rf.getLastLogIndex())
+		rf.mu.Unlock()
+		return -1, rf.currentTerm, false
+	}
+	servers := append([]int{server}, rf.config.Servers...)
+	rf.mu.Unlock()
+	return rf.ChangeConfig(servers)
+}
+
+// 只改变learner的配置变更, voter不变, 调用时需要持有rf.mu
+func (rf *Raft) changeLearners(learners []int) (int, int, bool) {
+	if rf.state != Leader {
+		return -1, rf.currentTerm, false
+	}
+	if rf.config.isJoint() || rf.configIndex > rf.commitIndex {
+		return -1, rf.currentTerm, false
+	}
+	for _, server := range learners {
+		if server < 0 || server >= len(rf.peers) || rf.peers[server] == nil {
+			return -1, rf.currentTerm, false
+		}
+	}
+	sort.Ints(learners)
+	DPrintf("Leader %d: change learners from %v to %v\n", rf.me, rf.config.Learners, learners)
+	rf.appendLog(configEntry(rf.currentTerm, Configuration{Servers: rf.config.Servers, Learners: learners}))
+	rf.persist()
+	return rf.configIndex, rf.currentTerm, true
+}
+
+//
+// register the RPC end point of a server that was not in the peers[]
+// passed to Make(), so that it can later be added with AddServer().
+//
+func (rf *Raft) AddPeer(server int, end *labrpc.ClientEnd) {
+	rf.AddPeerTransport(server, MakeLabrpcTransport(end))
+}
+
+// like AddPeer(), for a server reached through t.
+func (rf *Raft) AddPeerTransport(server int, t Transport) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	for len(rf.peers) <= server {
+		rf.peers = append(rf.peers, nil)
+	}
+	rf.peers[server] = t
+}
+
+//
+// return the latest configuration in this server's log, and whether
+// it has been committed.
+//
+func (rf *Raft) GetConfiguration() (Configuration, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	c := Configuration{
+		Servers:    append([]int{}, rf.config.Servers...),
+		OldServers: append([]int{}, rf.config.OldServers...),
+		Learners:   append([]int{}, rf.config.Learners...),
+	}
+	return c, rf.configIndex <= rf.commitIndex
+}
+
+// 切换到index处的配置, 调用时需要持有rf.mu
+func (rf *Raft) setConfig(c Configuration, index int) {
+	before := rf.config.replicas()
+	rf.config = c
+	rf.configIndex = index
+	// 记下被移除的server, leader在C_new提交之前继续给它们发送日志
+	rf.leavingServers = []int{}
+	for _, server := range before {
+		if !c.isVoter(server) && !c.isLearner(server) {
+			rf.leavingServers = append(rf.leavingServers, server)
+		}
+	}
+	if rf.state == Leader {
+		for _, server := range c.replicas() {
+			if _, ok := rf.nextIndex[server]; !ok {
+				rf.nextIndex[server] = rf.getLastLogIndex() + 1
+				rf.matchIndex[server] = 0
+			}
+		}
+	}
+}
+
+// 日志被截断后重新找出最新的配置: 先在log里从后往前找, 找不到就用快照里的配置
+func (rf *Raft) reloadConfig() {
+	for i := len(rf.log) - 1; i >= 0; i-- {
+		if c, ok := rf.log[i].config(); ok {
+			rf.setConfig(c, rf.lastIncludedIndex+i+1)
+			return
+		}
+	}
+	rf.setConfig(rf.snapshotConfig, rf.lastIncludedIndex)
+}
+
+// index处(含)生效的配置, 用来给快照记录配置
+func (rf *Raft) configAt(index int) Configuration {
+	for i := index - rf.lastIncludedIndex - 1; i >= 0; i-- {
+		if c, ok := rf.log[i].config(); ok {
+			return c
+		}
+	}
+	return rf.snapshotConfig
+}
+
+// leader在commitIndex前进后推进配置变更:
+// 联合配置提交后追加C_new; C_new提交后, 如果自己已经不在集群中就退位
+func (rf *Raft) advanceConfig() {
+	if rf.state != Leader || rf.configIndex > rf.commitIndex {
+		return
+	}
+	if rf.config.isJoint() {
+		DPrintf("Leader %d: joint configuration committed, switch to %v\n", rf.me, rf.config.Servers)
+		rf.appendLog(configEntry(rf.currentTerm, Configuration{Servers: rf.config.Servers, Learners: rf.config.Learners}))
+		rf.persist()
+	} else if !rf.config.isVoter(rf.me) {
+		DPrintf("Leader %d: removed from the configuration, step down\n", rf.me)
+		rf.stepDown()
+	}
+}
+
+// leader需要发送日志的server
+func (rf *Raft) replicaTargets() []int {
+	targets := []int{}
+	servers := rf.config.replicas()
+	// C_new提交之前继续给被移除的server发送日志, 让它们知道自己已经不在集群中, 不再发起选举
+	if rf.configIndex > rf.commitIndex {
+		servers = append(servers, rf.leavingServers...)
+	}
+	for _, server := range servers {
+		if server != rf.me && !containsServer(targets, server) {
+			targets = append(targets, server)
+		}
+	}
+	return targets
+}
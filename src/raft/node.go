@@ -0,0 +1,148 @@
+package raft
+
+//
+// 带类型的Raft: Node[C]只接受类型为C的命令, 通过ApplyCh()交给service的也是C,
+// service不用再对ApplyMsg.Command做类型断言.
+//
+// Node在Raft外面包一层: 自己创建applyCh, 把ApplyMsg转换成Applied[C].
+// raft自己追加的日志(NoOp和配置)不会交给service. 解码出来的命令不是C时
+// (比如集群里有server用了别的类型), 和解码失败一样, Raft直接panic.
+// 没有类型的Make()/Start()/ApplyMsg保持不变, 测试仍然使用它们.
+//
+
+import (
+	"context"
+	"fmt"
+	"labrpc"
+	"reflect"
+	"sync"
+)
+
+//
+// a committed command, or a snapshot when UseSnapshot is true, as
+// sent on a Node's ApplyCh().
+//
+type Applied[C any] struct {
+	Index       int
+	Command     C
+	UseSnapshot bool   // true if this message carries a snapshot up to Index
+	Snapshot    []byte // the snapshot when UseSnapshot is true
+}
+
+// a Raft peer whose commands have type C.
+type Node[C any] struct {
+	rf      *Raft
+	raw     chan ApplyMsg
+	applyCh chan Applied[C]
+	done    chan struct{}
+	wg      sync.WaitGroup
+	kill    sync.Once
+}
+
+//
+// like MakeWithOptions(), but for commands of type C. opts.Codec must
+// decode commands into values of type C, e.g. GobCodec{} with C
+// gob.Register()ed, or MakeJSONCodec() with a C.
+//
+func MakeNode[C any](peers []*labrpc.ClientEnd, me int,
+	storage Storage, opts Options) (*Node[C], error) {
+	return MakeNodeWithTransport[C](labrpcTransports(peers), me, storage, opts)
+}
+
+//
+// like MakeNode(), but peers[i] is how this server reaches server i,
+// as with MakeWithTransport().
+//
+func MakeNodeWithTransport[C any](peers []Transport, me int,
+	storage Storage, opts Options) (*Node[C], error) {
+	if opts.Codec != nil {
+		opts.Codec = typedCodec[C]{opts.Codec}
+	}
+	n := &Node[C]{
+		raw:     make(chan ApplyMsg),
+		applyCh: make(chan Applied[C]),
+		done:    make(chan struct{}),
+	}
+	rf, err := MakeWithTransport(peers, me, storage, n.raw, opts)
+	if err != nil {
+		return nil, err
+	}
+	n.rf = rf
+	n.wg.Add(1)
+	go n.convert()
+	return n, nil
+}
+
+// 把Raft的ApplyMsg转换成Applied[C], 直到Kill()
+func (n *Node[C]) convert() {
+	defer n.wg.Done()
+	for {
+		var m ApplyMsg
+		select {
+		case m = <-n.raw:
+		case <-n.done:
+			return
+		}
+		if m.Internal {
+			continue
+		}
+		a := Applied[C]{Index: m.Index, UseSnapshot: m.UseSnapshot, Snapshot: m.Snapshot}
+		if !m.UseSnapshot {
+			a.Command = m.Command.(C) // typedCodec保证了类型
+		}
+		select {
+		case n.applyCh <- a:
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// the underlying Raft, for everything that doesn't involve commands.
+func (n *Node[C]) Raft() *Raft {
+	return n.rf
+}
+
+// committed commands and snapshots, in log order. closed by Kill().
+func (n *Node[C]) ApplyCh() <-chan Applied[C] {
+	return n.applyCh
+}
+
+// see Raft.Start().
+func (n *Node[C]) Start(command C) (int, int, bool) {
+	return n.rf.Start(command)
+}
+
+// see Raft.Propose().
+func (n *Node[C]) Propose(ctx context.Context, command C) *Future {
+	return n.rf.Propose(ctx, command)
+}
+
+//
+// kill the underlying Raft, and close ApplyCh() once nothing more
+// will be sent on it. calling Kill() again does nothing.
+//
+func (n *Node[C]) Kill() {
+	n.kill.Do(func() {
+		n.rf.Kill()
+		close(n.done)
+		n.wg.Wait()
+		close(n.applyCh)
+	})
+}
+
+// 解码出来的命令必须是C, 否则当作解码失败
+type typedCodec[C any] struct {
+	Codec
+}
+
+func (tc typedCodec[C]) Decode(data []byte) (interface{}, error) {
+	command, err := tc.Codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := command.(C); !ok {
+		return nil, fmt.Errorf("raft: decoded a %T command; expected %v", command, reflect.TypeOf((*C)(nil)).Elem())
+	}
+	return command, nil
+}
@@ -0,0 +1,141 @@
+package raft
+
+//
+// Raft的可配置参数, 传给MakeWithOptions().
+//
+// 原先这些都是写死在代码里的常量(选举超时200ms-400ms, 心跳100ms),
+// 各个可选功能(PreVote, CheckQuorum, ...)也都是默认关闭的,
+// 现在统一放到Options里, Make()使用DefaultOptions().
+//
+
+import (
+	"errors"
+	"labrpc"
+	"time"
+)
+
+type Options struct {
+	// 选举超时在[ElectionTimeoutMin, ElectionTimeoutMax)之间随机选取
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+	// leader发送心跳的间隔, 必须远小于选举超时
+	HeartbeatInterval time.Duration
+
+	// 一个AppendEntries最多携带的日志条数和(gob编码后的)字节数, 0表示不限制
+	// 至少会携带一条日志, 即使它本身就超过了MaxBytesPerRPC
+	MaxEntriesPerRPC int
+	MaxBytesPerRPC   int
+	// leader对每个follower同时进行中的携带日志的AppendEntries的上限(流水线的深度), 0表示不限制
+	MaxInflightRPCs int
+
+	// 在正式选举前先进行预投票, 见startPreVote()
+	PreVote bool
+	// leader一个选举超时内联系不上多数派时主动退位, 见HasQuorum()
+	CheckQuorum bool
+	// 允许leader在租约内直接服务读请求, 见LeaseRead()
+	// 开启后follower在收到leader的消息之后的一个最小选举超时内不会给别人投票,
+	// 所以集群中所有server都要使用相同的设置
+	LeaseRead bool
+	// 允许的各server之间时钟速率的误差, 租约会相应地缩短
+	ClockDrift time.Duration
+	// follower的Start()把命令转发给它知道的leader, 见forwardProposal()
+	ForwardProposals bool
+
+	// 初始配置中的learner, 其余的peers是voter; 集群中所有server都要使用相同的设置
+	InitialLearners []int
+	// PromoteLearner()只提升日志落后leader不超过这么多条的learner
+	MaxPromotionLag int
+
+	// 编码service的命令, 见codec.go; 集群中所有server都要使用相同的Codec
+	Codec Codec
+}
+
+//
+// the settings Make() uses: a 200-400ms election timeout, 100ms
+// heartbeats, up to 256 entries per AppendEntries with 4 of them in
+// flight to each follower, learners promotable once they are within
+// 256 entries of the leader, commands encoded with gob, and all
+// optional features turned off.
+//
+func DefaultOptions() Options {
+	return Options{
+		ElectionTimeoutMin: 200 * time.Millisecond,
+		ElectionTimeoutMax: 400 * time.Millisecond,
+		HeartbeatInterval:  100 * time.Millisecond,
+		MaxEntriesPerRPC:   256,
+		MaxInflightRPCs:    4,
+		MaxPromotionLag:    256,
+		Codec:              GobCodec{},
+	}
+}
+
+//
+// check that the settings make sense together. MakeWithOptions()
+// calls it, so services only need it to check their options early.
+//
+func (c Options) Validate() error {
+	if c.ElectionTimeoutMin <= 0 || c.ElectionTimeoutMax <= c.ElectionTimeoutMin {
+		return errors.New("raft: election timeout range must be positive and non-empty")
+	}
+	// 选举超时以毫秒为单位随机选取(见newElectionTimeout()), 范围不到1ms时没有可选的值
+	if c.ElectionTimeoutMin < time.Millisecond || c.ElectionTimeoutMax-c.ElectionTimeoutMin < time.Millisecond {
+		return errors.New("raft: election timeout must be at least a millisecond, with a range at least a millisecond wide")
+	}
+	// 心跳间隔至少要比最小选举超时小一半, 丢一个心跳包不至于引发选举
+	if c.HeartbeatInterval <= 0 || 2*c.HeartbeatInterval > c.ElectionTimeoutMin {
+		return errors.New("raft: heartbeat interval must be at most half the minimum election timeout")
+	}
+	if c.MaxEntriesPerRPC < 0 || c.MaxBytesPerRPC < 0 || c.MaxInflightRPCs < 0 {
+		return errors.New("raft: AppendEntries limits must not be negative")
+	}
+	if c.Codec == nil {
+		return errors.New("raft: a Codec is required")
+	}
+	if c.MaxPromotionLag < 0 {
+		return errors.New("raft: learner promotion lag must not be negative")
+	}
+	if c.ClockDrift < 0 || (c.LeaseRead && c.ClockDrift >= c.ElectionTimeoutMin) {
+		return errors.New("raft: clock drift must be non-negative and shorter than the minimum election timeout")
+	}
+	return nil
+}
+
+//
+// like Make(), but with the given settings instead of DefaultOptions(),
+// and with the state kept in storage rather than a Persister (wrap a
+// Persister with MakePersisterStorage()). returns an error, without starting anything, if the settings are
+// invalid or the persisted state can't be read (e.g. ErrCorruptState,
+// ErrUnsupportedVersion, or whatever error storage returned).
+//
+func MakeWithOptions(peers []*labrpc.ClientEnd, me int,
+	storage Storage, applyCh chan ApplyMsg, opts Options) (*Raft, error) {
+	return MakeWithTransport(labrpcTransports(peers), me, storage, applyCh, opts)
+}
+
+//
+// like MakeWithOptions(), but peers[i] is how this server reaches
+// server i, e.g. through the service's own RPC stack. peers[me] isn't
+// used, and may be nil.
+//
+func MakeWithTransport(peers []Transport, me int,
+	storage Storage, applyCh chan ApplyMsg, opts Options) (*Raft, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	// 初始配置里至少要有一个voter, 否则永远选不出leader
+	voters := 0
+	for i := range peers {
+		if !containsServer(opts.InitialLearners, i) {
+			voters++
+		}
+	}
+	if voters == 0 {
+		return nil, errors.New("raft: the initial configuration needs at least one voter")
+	}
+	return makeRaft(peers, me, storage, applyCh, opts)
+}
+
+// 在[ElectionTimeoutMin, ElectionTimeoutMax)之间随机选取一个选举超时, 单位ms
+func (rf *Raft) newElectionTimeout() int {
+	return GenerateElectionTimeout(int(rf.opts.ElectionTimeoutMin/time.Millisecond), int(rf.opts.ElectionTimeoutMax/time.Millisecond))
+}
@@ -11,6 +11,20 @@ package raft
 
 import "sync"
 
+//
+// a store for Raft's state as a single blob, plus a snapshot:
+// Persister keeps everything in memory, FilePersister writes it to
+// disk. Raft uses one through MakePersisterStorage().
+//
+type StateStore interface {
+	SaveRaftState(data []byte)
+	ReadRaftState() []byte
+	RaftStateSize() int
+	ReadSnapshot() []byte
+	SnapshotSize() int
+	SaveStateAndSnapshot(state []byte, snapshot []byte)
+}
+
 type Persister struct {
 	mu        sync.Mutex
 	raftstate []byte
@@ -65,3 +79,12 @@ func (ps *Persister) SnapshotSize() int {
 	defer ps.mu.Unlock()
 	return len(ps.snapshot)
 }
+
+// save both Raft state and snapshot as a single atomic action,
+// to help avoid them getting out of sync.
+func (ps *Persister) SaveStateAndSnapshot(state []byte, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.raftstate = state
+	ps.snapshot = snapshot
+}
@@ -0,0 +1,177 @@
+package raft
+
+//
+// 带结果的Start: Propose()返回一个Future, 命令提交并交给service之后
+// Future返回它的索引; 命令不可能再提交(被新leader的日志覆盖)、
+// 或者leader退位后无法知道结果时返回对应的错误.
+//
+// leader退位时不会马上放弃: 新leader的日志可能保留了这些命令,
+// 在一个最大选举超时内仍然根据apply/截断的情况给出确定的结果,
+// 超时之后才返回ErrLeadershipLost.
+//
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrLeadershipLost = errors.New("raft: lost leadership before the entry committed, outcome unknown")
+	ErrTermChanged    = errors.New("raft: entry was overwritten by a leader of a later term")
+	ErrShutdown       = errors.New("raft: server was killed")
+)
+
+//
+// the outcome of a Propose(). Wait() blocks until the command has
+// been committed and sent on applyCh, or until Raft knows it can't
+// tell, or until the context passed to Propose() is done.
+//
+type Future struct {
+	rf    *Raft
+	ctx   context.Context
+	index int
+	term  int
+	done  chan struct{}
+	err   error
+}
+
+// the log index the command was placed at, or -1 if it wasn't.
+func (f *Future) Index() int {
+	return f.index
+}
+
+// the term the command was proposed in.
+func (f *Future) Term() int {
+	return f.term
+}
+
+// closed once the outcome is known.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//
+// wait for the outcome: the command's index and nil once it has been
+// applied, or one of ErrNotLeader, ErrLeadershipLost, ErrTermChanged,
+// ErrShutdown, the context's error, or the Codec's error. once the
+// context is done Raft stops tracking the command, and the Future
+// keeps the context's error even if the command commits later.
+//
+func (f *Future) Wait() (int, error) {
+	select {
+	case <-f.done:
+	case <-f.ctx.Done():
+		f.rf.mu.Lock()
+		// 结果可能刚好已经出来了, 还在proposals里说明还没有结果
+		if f.rf.proposals[f.index] == f {
+			delete(f.rf.proposals, f.index)
+			f.resolve(f.ctx.Err())
+		}
+		f.rf.mu.Unlock()
+	}
+	return f.index, f.err
+}
+
+// 调用时需要持有rf.mu
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+//
+// like Start(), but returns a Future that reports whether the
+// command was committed. only the leader accepts proposals; unlike
+// Start(), Propose() never forwards the command to the leader. if
+// Options.Codec can't encode the command, the Future fails with the
+// Codec's error.
+//
+func (rf *Raft) Propose(ctx context.Context, command interface{}) *Future {
+	data, err := rf.opts.Codec.Encode(command)
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	f := &Future{rf: rf, ctx: ctx, index: -1, term: rf.currentTerm, done: make(chan struct{})}
+	if rf.killed() {
+		f.resolve(ErrShutdown)
+		return f
+	}
+	if err != nil {
+		f.resolve(err)
+		return f
+	}
+	index, term, isLeader := rf.start(data)
+	if !isLeader {
+		f.resolve(ErrNotLeader)
+		return f
+	}
+	f.index = index
+	f.term = term
+	rf.proposals[index] = f
+	return f
+}
+
+// index处的日志已经交给了service, 任期号为term, 调用时需要持有rf.mu
+func (rf *Raft) proposalApplied(index int, term int) {
+	f, ok := rf.proposals[index]
+	if !ok {
+		return
+	}
+	delete(rf.proposals, index)
+	if f.term == term {
+		f.resolve(nil)
+	} else {
+		f.resolve(ErrTermChanged)
+	}
+}
+
+// 索引大于index的日志被截掉了, 调用时需要持有rf.mu
+func (rf *Raft) proposalsTruncated(index int) {
+	for i, f := range rf.proposals {
+		if i > index {
+			delete(rf.proposals, i)
+			f.resolve(ErrTermChanged)
+		}
+	}
+}
+
+// 任期号不超过term、还没有结果的proposal都以err结束, 调用时需要持有rf.mu
+func (rf *Raft) abandonProposals(term int, err error) {
+	for i, f := range rf.proposals {
+		if f.term <= term {
+			delete(rf.proposals, i)
+			f.resolve(err)
+		}
+	}
+}
+
+// 索引不超过index、还没有结果的proposal都以err结束, 调用时需要持有rf.mu
+func (rf *Raft) abandonProposalsUpTo(index int, err error) {
+	for i, f := range rf.proposals {
+		if i <= index {
+			delete(rf.proposals, i)
+			f.resolve(err)
+		}
+	}
+}
+
+// leader退位了, 等一个最大选举超时看看能不能知道结果, 调用时需要持有rf.mu
+func (rf *Raft) proposalsOrphaned() {
+	if len(rf.proposals) == 0 || rf.killed() {
+		return
+	}
+	term := rf.currentTerm
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		select {
+		case <-time.After(rf.opts.ElectionTimeoutMax):
+		case <-rf.killCh:
+			// Kill()已经让所有proposal返回ErrShutdown了
+			return
+		}
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		rf.abandonProposals(term, ErrLeadershipLost)
+	}()
+}
@@ -11,6 +11,12 @@ package raft
 //   start agreement on a new log entry
 // rf.GetState() (term, isLeader)
 //   ask a Raft for its current term, and whether it thinks it is leader
+// rf.Snapshot(index, snapshot)
+//   the service has a snapshot up to index; discard the log before it
+// rf.ChangeConfig(servers) (index, term, ok)
+//   switch the cluster to a new set of voting servers (see membership.go)
+// rf.TransferLeadership(target) ok
+//   hand leadership to another server (see transfer.go)
 // ApplyMsg
 //   each time a new entry is committed to the log, each Raft peer
 //   should send an ApplyMsg to the service (or tester)
@@ -19,12 +25,14 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"fmt"
 	"labrpc"
 	"math"
 	"math/rand"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,24 +44,33 @@ import (
 type ApplyMsg struct {
 	Index       int
 	Command     interface{}
-	UseSnapshot bool   // ignore for lab2; only used in lab3
-	Snapshot    []byte // ignore for lab2; only used in lab3
+	UseSnapshot bool   // true if this message carries a snapshot up to Index
+	Snapshot    []byte // the snapshot when UseSnapshot is true
+	Internal    bool   // true if Command was added by Raft itself (a NoOp or a Configuration) and should be ignored
+}
+
+// 新leader在自己的任期追加的空日志, 见convertToLeader()
+type NoOp struct{}
+
+func init() {
+	gob.Register(NoOp{})
 }
 
 const (
-	Follower  string = "follower"
-	Candidate        = "candidate"
-	Leader           = "leader"
+	Follower     string = "follower"
+	PreCandidate        = "pre-candidate"
+	Candidate           = "candidate"
+	Leader              = "leader"
 )
 
 //
 // A Go object implementing a single Raft peer.
 //
 type Raft struct {
-	mu        sync.Mutex          // Lock to protect shared access to this peer's state
-	peers     []*labrpc.ClientEnd // RPC end points of all peers
-	persister *Persister          // Object to hold this peer's persisted state
-	me        int                 // this peer's index into peers[]
+	mu      sync.Mutex  // Lock to protect shared access to this peer's state
+	peers   []Transport // RPC end points of all peers
+	storage Storage     // Object to hold this peer's persisted state
+	me      int         // this peer's index into peers[]
 
 	// Your data here (2A, 2B, 2C).
 	// Look at the paper's Figure 2 for a description of what
@@ -67,8 +84,8 @@ type Raft struct {
 	commitIndex int
 	lastApplied int
 	// volatile state on leaders
-	nextIndex  []int
-	matchIndex []int
+	nextIndex  map[int]int
+	matchIndex map[int]int
 	// some other self-added states
 	state           string
 	electionTimeout int
@@ -76,8 +93,54 @@ type Raft struct {
 	grantVoteCh     chan bool
 	heartBeatCh     chan bool
 	leaderCh        chan bool
-	totalVotes      int
+	votes           map[int]bool // 本轮选举中投给自己的server
 	timer           *time.Timer
+	// 日志压缩相关, 快照中最后一条日志的索引和任期号
+	// rf.log[0]对应的索引是lastIncludedIndex+1
+	lastIncludedIndex int
+	lastIncludedTerm  int
+	stored            storedState
+	// 由独立的applier goroutine负责向applyCh发送, 避免持锁阻塞在applyCh上
+	applyCond       *sync.Cond
+	snapshotPending bool // 有新安装的快照等待交给service
+	// 集群成员变更相关, 见membership.go
+	config         Configuration // 日志中最新的配置(不一定已提交)
+	configIndex    int           // config所在的日志索引, 来自快照或初始配置时为lastIncludedIndex
+	snapshotConfig Configuration // 快照中最后生效的配置
+	leavingServers []int         // 最近一次配置变更中被移除的server
+	// 领导权转移相关, 见transfer.go
+	transferTarget int // 正在转移领导权的目标, 没有时为-1
+	timeoutNowCh   chan bool
+	timeoutNowTerm int // 最近一次收到TimeoutNow时的任期号
+	// PreVote相关
+	preVoteCh     chan bool // 预投票得到多数派同意
+	lastHeartbeat time.Time // 最近一次收到当前leader的AppendEntries/InstallSnapshot(或者投出选票)的时间
+	// 可配置的参数和可选功能, 见options.go
+	opts Options
+	// 日志复制相关, 见replication.go
+	replicateCh map[int]chan bool // 唤醒每个follower的replicator
+	inflight    map[int]int       // 发给每个follower、还没有返回的携带日志的AppendEntries数量
+	installing  map[int]bool      // 是否正在给follower发送快照
+	proposals   map[int]*Future   // Propose()发起、还没有结果的命令, 以日志索引为key
+	// CheckQuorum相关
+	lastAck map[int]time.Time // 当前任期内每个server最近一次确认的RPC的发送时间
+	// ReadIndex相关, 见read.go
+	// 等待确认领导地位、提交或者service收到日志的读请求, 这些状态变化时都会Broadcast
+	readCond       *sync.Cond
+	heartbeatAfter time.Time // replicator要在这之后给每个follower发一次AppendEntries
+	// 本次选举是不是由TimeoutNow触发的, 租约期间follower只给这种候选人投票
+	transferElection bool
+	// 当前任期的leader, 不知道时为-1
+	// votedFor在收到leader的消息时也会记成leader, 但投票之后就不一定是leader了
+	leaderId int
+	// service已经从applyCh收到的最大日志索引, lastApplied在发送之前就增加了
+	deliveredIndex int
+	// Kill()相关
+	dead   int32              // Kill()之后为1
+	killCh chan struct{}      // Kill()时关闭, 通知所有goroutine退出
+	wg     sync.WaitGroup     // Raft自己启动的所有goroutine, Kill()等待它们全部退出
+	ctx    context.Context    // 传给Transport的每个RPC, Kill()时取消
+	cancel context.CancelFunc // 取消ctx
 }
 
 // return currentTerm and whether this server
@@ -96,6 +159,16 @@ func (rf *Raft) GetState() (int, bool) {
 	return term, isleader
 }
 
+//
+// return the server this one believes is the leader of its current
+// term, or -1 if it doesn't know, along with the current term.
+//
+func (rf *Raft) GetLeader() (int, int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.leaderId, rf.currentTerm
+}
+
 //
 // save Raft's persistent state to stable storage,
 // where it can later be retrieved after a crash and restart.
@@ -111,19 +184,95 @@ func (rf *Raft) persist() {
 	// data := w.Bytes()
 	// rf.persister.SaveRaftState(data)
 
-	w := new(bytes.Buffer)
-	e := gob.NewEncoder(w)
-	e.Encode(rf.currentTerm)
-	e.Encode(rf.votedFor)
-	e.Encode(rf.log)
-	data := w.Bytes()
-	rf.persister.SaveRaftState(data)
+	// 只把和上次保存时不同的部分交给storage
+	st := HardState{Term: rf.currentTerm, VotedFor: rf.votedFor}
+	if st != rf.stored.hardState {
+		if err := rf.storage.SetHardState(st); err != nil {
+			rf.storageFailed(err)
+		}
+		rf.stored.hardState = st
+	}
+	if rf.lastIncludedIndex != rf.stored.lastIncludedIndex {
+		// 压缩日志总是伴随着一个新快照, 见persistWithSnapshot()
+		panic(fmt.Sprintf("raft: log compacted to %v without a snapshot", rf.lastIncludedIndex))
+	}
+	// 相同索引和任期号的日志一定相同(Log Matching), 从后往前找到和已保存的日志一致的最长前缀,
+	// 通常只需要比较最后一条, 之后的日志就是新增的或者覆盖了冲突的日志
+	k := len(rf.stored.terms)
+	if len(rf.log) < k {
+		k = len(rf.log)
+	}
+	for k > 0 && rf.stored.terms[k-1] != rf.log[k-1].Term {
+		k--
+	}
+	if k == len(rf.stored.terms) && k == len(rf.log) {
+		return
+	}
+	if err := rf.storage.StoreEntries(rf.lastIncludedIndex+k+1, rf.log[k:]); err != nil {
+		rf.storageFailed(err)
+	}
+	rf.stored.terms = rf.stored.terms[:k]
+	for _, e := range rf.log[k:] {
+		rf.stored.terms = append(rf.stored.terms, e.Term)
+	}
+}
+
+// storage里已经保存的状态, 用来找出每次persist()变化的部分
+type storedState struct {
+	hardState         HardState
+	lastIncludedIndex int
+	terms             []int // lastIncludedIndex之后每条日志的任期号
 }
 
 //
-// restore previously persisted state.
+// 持久化raft状态的同时保存快照, 两者必须一起写入,
+// 否则crash后可能出现日志已经截断但快照还是旧的情况
 //
-func (rf *Raft) readPersist(data []byte) {
+func (rf *Raft) persistWithSnapshot(snapshot []byte) {
+	st := HardState{Term: rf.currentTerm, VotedFor: rf.votedFor}
+	if st != rf.stored.hardState {
+		if err := rf.storage.SetHardState(st); err != nil {
+			rf.storageFailed(err)
+		}
+		rf.stored.hardState = st
+	}
+	meta := SnapshotMeta{
+		LastIncludedIndex: rf.lastIncludedIndex,
+		LastIncludedTerm:  rf.lastIncludedTerm,
+		Config:            rf.snapshotConfig,
+	}
+	if err := rf.storage.SaveSnapshot(meta, snapshot, rf.log); err != nil {
+		rf.storageFailed(err)
+	}
+	rf.stored.lastIncludedIndex = rf.lastIncludedIndex
+	rf.stored.terms = []int{}
+	for _, e := range rf.log {
+		rf.stored.terms = append(rf.stored.terms, e.Term)
+	}
+}
+
+//
+// 写storage失败之后不知道哪些状态已经保存了, 继续运行可能违反之前的投票或者
+// 丢掉已经回复过leader的日志, 只能像crash一样停下来
+//
+func (rf *Raft) storageFailed(err error) {
+	panic(fmt.Sprintf("raft: server %d can't save its state: %v", rf.me, err))
+}
+
+// 当前的快照, 调用时需要持有rf.mu
+func (rf *Raft) readSnapshot() []byte {
+	snapshot, err := rf.storage.Snapshot()
+	if err != nil {
+		panic(fmt.Sprintf("raft: server %d can't read its snapshot: %v", rf.me, err))
+	}
+	return snapshot
+}
+
+//
+// restore previously persisted state. returns an error, instead of
+// starting over from term 0, if the state can't be read.
+//
+func (rf *Raft) readPersist() error {
 	// Your code here (2C).
 	// Example:
 	// r := bytes.NewBuffer(data)
@@ -131,14 +280,32 @@ func (rf *Raft) readPersist(data []byte) {
 	// d.Decode(&rf.xxx)
 	// d.Decode(&rf.yyy)
 
-	r := bytes.NewBuffer(data)
-	d := gob.NewDecoder(r)
-	d.Decode(&rf.currentTerm)
-	d.Decode(&rf.votedFor)
-	d.Decode(&rf.log)
-	if data == nil || len(data) < 1 { // bootstrap without any state?
-		return
+	st, meta, err := rf.storage.InitialState()
+	if err != nil {
+		return err
+	}
+	last, err := rf.storage.LastIndex()
+	if err != nil {
+		return err
+	}
+	log, err := rf.storage.Entries(meta.LastIncludedIndex+1, last+1)
+	if err != nil {
+		return err
+	}
+	rf.currentTerm = st.Term
+	rf.votedFor = st.VotedFor
+	rf.lastIncludedIndex = meta.LastIncludedIndex
+	rf.lastIncludedTerm = meta.LastIncludedTerm
+	// 还没有快照时保留Make()里的初始配置
+	if meta.LastIncludedIndex > 0 {
+		rf.snapshotConfig = meta.Config
 	}
+	rf.log = log
+	rf.stored = storedState{hardState: st, lastIncludedIndex: meta.LastIncludedIndex, terms: []int{}}
+	for _, e := range log {
+		rf.stored.terms = append(rf.stored.terms, e.Term)
+	}
+	return nil
 }
 
 //
@@ -151,6 +318,10 @@ type RequestVoteArgs struct {
 	CandidateId  int
 	LastLogIndex int
 	LastLogTerm  int
+	// 预投票: 只是询问对方是否会投票, 不会让对方更新任期或者记录投票
+	PreVote bool
+	// 领导权转移发起的选举, 即使leader的租约还有效也可以投票
+	LeadershipTransfer bool
 }
 
 //
@@ -171,6 +342,24 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 	DPrintf("Server %d: got RequestVote from candidate %d, args: %+v, current currentTerm: %d, current log: %v\n", rf.me, args.CandidateId, args, rf.currentTerm, rf.log)
+	if args.PreVote {
+		rf.handlePreVote(args, reply)
+		return
+	}
+	// 租约读: 认为leader的租约还有效时直接忽略投票请求, 也不更新任期
+	// 否则旧leader还在租约内服务读请求时, 可能已经选出了新leader并提交了新的写
+	if rf.opts.LeaseRead && !args.LeadershipTransfer && rf.inLeaderLease() {
+		DPrintf("Server %d: reject RequestVote from candidate %d, leader lease still active\n", rf.me, args.CandidateId)
+		reply.Term = rf.currentTerm
+		reply.VoteGranted = false
+		return
+	}
+	// 投出的选票也会被新leader当作对它的确认(见recordAck), 和收到心跳一样处理
+	defer func() {
+		if reply.VoteGranted {
+			rf.lastHeartbeat = time.Now()
+		}
+	}()
 	// 请求发起的选举任期比当前记录的任期低，不用管
 	if args.Term < rf.currentTerm {
 		reply.Term = rf.currentTerm
@@ -196,11 +385,8 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 				// 如果s2, s3都直接同意投票则s1会当选为领导, 那么后续再有添加日志的操作会造成和s2, s3 committed log不一样的情况
 				// 所以在s1选举时就要做好判断！
 				// 当前server的最新log索引值，任期号
-				lastLogIndex := len(rf.log)
-				lastLogTerm := 0
-				if lastLogIndex > 0 {
-					lastLogTerm = rf.log[lastLogIndex-1].Term
-				}
+				lastLogIndex := rf.getLastLogIndex()
+				lastLogTerm := rf.getLastLogTerm()
 				// 这个请求投票的server的日志任期号比我的旧，不投给它
 				if args.LastLogTerm < lastLogTerm {
 					reply.Term = rf.currentTerm
@@ -233,11 +419,8 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 		} else {
 			rf.convertToFollower(args.Term, -1)
 			// up-to-date check
-			lastLogIndex := len(rf.log)
-			lastLogTerm := 0
-			if lastLogIndex > 0 {
-				lastLogTerm = rf.log[lastLogIndex-1].Term
-			}
+			lastLogIndex := rf.getLastLogIndex()
+			lastLogTerm := rf.getLastLogTerm()
 			if args.LastLogTerm < lastLogTerm {
 				reply.Term = rf.currentTerm
 				reply.VoteGranted = false
@@ -314,86 +497,53 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	} else { //大于的话改变节点状态
 		// 正在处理heartBeat
 		rf.setHeartBeatCh()
+		rf.lastHeartbeat = time.Now()
 		// 把自己变成follower，follower本来就是follower，
 		// 而错误的leader也会收到真leader发来的heartBeat，把自己变成follower
 		// 转换包括记录leader的任期号，改变自身状态，获得的票数，以及记录leader的id
 		rf.convertToFollower(args.Term, args.LeaderId)
-		// PrevLogIndex为0表示从头开始appendEntries, 不用进入后续判断, 语义上更好理解
-		if args.PrevLogIndex == 0 {
-			// 回复leader，该raft服务器保存的任期号是多少
-			reply.Term = rf.currentTerm
-			// 日志的同步是成功的
-			reply.Success = true
-			originLogEntries := rf.log
-			lastNewEntry := 0
-			// 尽管Previndex是0，但follower有更多的日志项，
-			// follower可能接收到了过期的同步日志请求，超出的部分除了不一致的其余不需要替换
-			// 示例：
-			// raft.logs    = prev(0) n x x x
-			// leader.logs  = prev(0) x x
-			// args.entris  =         x x
-			// 更新后
-			// raft.logs    = prev(0) x x x x
-			if args.PrevLogIndex+len(args.Entries) < len(originLogEntries) {
-				lastNewEntry = args.PrevLogIndex + len(args.Entries)
-				for i := 0; i < len(args.Entries); i++ {
-					if args.Entries[i] != originLogEntries[args.PrevLogIndex+i] {
-						rf.log = append(rf.log[:args.PrevLogIndex+i], args.Entries[i:]...)
-						lastNewEntry = len(rf.log)
-						break
-					}
-				}
-			} else { // 没有以上情况，直接用leader给的日志项替代prevIndex后的日志项
-				// 示例
-				// ref.logs =      prev(0) x x
-				// or ref.logs =   prev(0)
-				// leader.logs  =  prev(0) x n x
-				// args.entries =          x n x
-				// 更新后:
-				// ref.logs =      prev(0) x n x
-				rf.log = append(rf.log[:args.PrevLogIndex], args.Entries...)
-				lastNewEntry = len(rf.log)
-			}
-			// 更新follower所知道的最新的提交的日志的索引
-			// leaderCommit > commitIndex的时候才更新!!!
-			// 惨痛的bug, 否则commitIndex可能变小
-			if args.LeaderCommit > rf.commitIndex {
-				rf.commitIndex = int(math.Min(float64(args.LeaderCommit), float64(lastNewEntry)))
+		rf.leaderId = args.LeaderId
+		// 日志压缩后, PrevLogIndex可能落在快照内部, 而快照里的日志都已经提交, 一定与leader一致
+		// 因此把快照已经覆盖的那部分entries去掉, 从lastIncludedIndex处开始比较
+		prevLogIndex := args.PrevLogIndex
+		prevLogTerm := args.PrevLogTerm
+		entries := args.Entries
+		if prevLogIndex < rf.lastIncludedIndex {
+			skip := rf.lastIncludedIndex - prevLogIndex
+			if skip > len(entries) {
+				skip = len(entries)
 			}
-			rf.persist()
-			rf.startApplyLogs()
-			return
+			entries = entries[skip:]
+			prevLogIndex = rf.lastIncludedIndex
+			prevLogTerm = rf.lastIncludedTerm
 		}
 		//如果当前节点本地的log[]结构中prevLogIndex索引处不含有日志, 则返回(currentTerm, false)
 		// 示例
 		// ref.logs =      x x
 		// leader.logs =   x x x prev x n x
 		// args.entries =             x n x
-		if len(rf.log) < args.PrevLogIndex {
+		if rf.getLastLogIndex() < prevLogIndex {
 			reply.Term = rf.currentTerm
 			reply.Success = false
 			// 报告矛盾的日志的索引值
-			reply.ConflictIndex = len(rf.log)
+			reply.ConflictIndex = rf.getLastLogIndex()
 			// 矛盾的类型是本地log比leader的log要更短
 			reply.ConflictTerm = -1
 		} else {
-			prevLogTerm := 0
-			// 检查PrevLogIndex处的日志任期号
-			if args.PrevLogIndex > 0 {
-				prevLogTerm = rf.log[args.PrevLogIndex-1].Term
-			}
+			// 检查PrevLogIndex处的日志任期号, prevLogIndex为lastIncludedIndex时(包括从头开始的0)一定是一致的
+			localPrevLogTerm := rf.getLogTerm(prevLogIndex)
 			// 任期不一致
-			if args.PrevLogTerm != prevLogTerm {
+			if prevLogTerm != localPrevLogTerm {
 				// 返回本地存储的leader任期号
 				reply.Term = rf.currentTerm
 				// 同步失败
 				reply.Success = false
 				// 冲突的任期号
-				reply.ConflictTerm = prevLogTerm
+				reply.ConflictTerm = localPrevLogTerm
 				// 找到哪个索引的日志任期号和PrevLog的任期号是一致的
 				for i := 0; i < len(rf.log); i++ {
-					if rf.log[i].Term == prevLogTerm {
-						reply.ConflictIndex = i + 1
+					if rf.log[i].Term == localPrevLogTerm {
+						reply.ConflictIndex = rf.lastIncludedIndex + i + 1
 						break
 					}
 				}
@@ -401,7 +551,6 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 				reply.Term = rf.currentTerm
 				// 可以完成同步
 				reply.Success = true
-				originLogEntries := rf.log
 				lastNewEntry := 0
 				// 必须要有这部分判断, 否则有可能使得当前最新的log被旧的log entries所替代
 				// 尽管follower和leader在PrevLog处是一致的，但follower还有更多的日志项，
@@ -412,15 +561,16 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 				// args.entries =           x n x
 				// 更新后:
 				// ref.logs =      x x prev x n x x x
-				if args.PrevLogIndex+len(args.Entries) < len(originLogEntries) {
+				if prevLogIndex+len(entries) < rf.getLastLogIndex() {
 					// 先检查一下要添加的日志项
-					lastNewEntry = args.PrevLogIndex + len(args.Entries)
-					for i := 0; i < len(args.Entries); i++ {
-						// 找到开始不一致的日志项
-						if args.Entries[i] != originLogEntries[args.PrevLogIndex+i] {
+					lastNewEntry = prevLogIndex + len(entries)
+					for i := 0; i < len(entries); i++ {
+						// 找到开始不一致的日志项, 索引和任期号都相同的日志项内容一定相同
+						if entries[i].Term != rf.getLogTerm(prevLogIndex+i+1) {
 							// 不一致的部分的日志项用leader给的日志项替代，其余保留
-							rf.log = append(rf.log[:args.PrevLogIndex+i], args.Entries[i:]...)
-							lastNewEntry = len(rf.log)
+							rf.truncateLog(prevLogIndex + i)
+							rf.appendLog(entries[i:]...)
+							lastNewEntry = rf.getLastLogIndex()
 							break
 						}
 					}
@@ -432,13 +582,15 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 					// args.entries =           x n x
 					// 更新后:
 					// ref.logs =      x x prev x n x
-					rf.log = append(rf.log[:args.PrevLogIndex], args.Entries...)
-					lastNewEntry = len(rf.log)
+					rf.truncateLog(prevLogIndex)
+					rf.appendLog(entries...)
+					lastNewEntry = rf.getLastLogIndex()
 				}
 				// 更新follower所知道的最新的提交的日志的索引
 				// 注意只有leader确认了该日志可以被提交，follower才更新自己的commitIndex
 				// 因此follower可能在本次心跳中得到了要添加的logs，但在下一个心跳包里确认leader提交了，
 				// follower才会提交上一次心跳包里的logs
+				// leaderCommit > commitIndex的时候才更新!!! 惨痛的bug, 否则commitIndex可能变小
 				if args.LeaderCommit > rf.commitIndex {
 					rf.commitIndex = int(math.Min(float64(args.LeaderCommit), float64(lastNewEntry)))
 				}
@@ -451,6 +603,88 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	DPrintf("======= server %d got AppendEntries from leader %d, args: %+v, current log: %v, reply: %+v =======\n", rf.me, args.LeaderId, args, rf.log, reply)
 }
 
+// 快照安装的 RPC
+// 当follower需要的日志已经被leader压缩进快照时, leader直接把快照发给follower
+type InstallSnapshotArgs struct {
+	// leader的任期号
+	Term int
+	// leader的id
+	LeaderId int
+	// 快照中最后一条日志的索引和任期号
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	// 快照中最后生效的集群配置
+	Config Configuration
+	// 快照数据, 不做分块
+	Data []byte
+}
+
+type InstallSnapshotReply struct {
+	// 返回的任期号，方便leader知道自己是否过期
+	Term int
+}
+
+// raft服务器收到leader发来的快照时的动作
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	DPrintf("Server %d: got InstallSnapshot from leader %d, lastIncludedIndex: %d, lastIncludedTerm: %d, current term: %d\n", rf.me, args.LeaderId, args.LastIncludedIndex, args.LastIncludedTerm, rf.currentTerm)
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return
+	}
+	rf.setHeartBeatCh()
+	rf.lastHeartbeat = time.Now()
+	rf.convertToFollower(args.Term, args.LeaderId)
+	rf.leaderId = args.LeaderId
+	reply.Term = rf.currentTerm
+	// 快照里的日志已经提交过了, 说明这是一个过期的快照, 不用管
+	if args.LastIncludedIndex <= rf.commitIndex {
+		return
+	}
+	// 本地有快照最后一条日志(索引和任期号都相同)时保留其后的日志, 否则整个log都作废
+	if args.LastIncludedIndex < rf.getLastLogIndex() && rf.getLogTerm(args.LastIncludedIndex) == args.LastIncludedTerm {
+		rf.log = append([]Entry{}, rf.log[args.LastIncludedIndex-rf.lastIncludedIndex:]...)
+	} else {
+		rf.log = []Entry{}
+		rf.proposalsTruncated(args.LastIncludedIndex)
+	}
+	// 快照里的命令不会单独apply, 不知道它们是不是自己提出的那些
+	rf.abandonProposalsUpTo(args.LastIncludedIndex, ErrLeadershipLost)
+	rf.lastIncludedIndex = args.LastIncludedIndex
+	rf.lastIncludedTerm = args.LastIncludedTerm
+	rf.snapshotConfig = args.Config
+	rf.reloadConfig()
+	rf.commitIndex = args.LastIncludedIndex
+	rf.persistWithSnapshot(args.Data)
+	// 快照由applier交给service, 保证它排在已经apply的日志之后
+	rf.snapshotPending = true
+	rf.startApplyLogs()
+}
+
+//
+// the service has applied every entry up to and including index and
+// hands Raft a snapshot of its state at that point. Raft discards the
+// log prefix covered by the snapshot and persists the remaining state
+// together with the snapshot.
+//
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	// 已经压缩过的, 或者还没apply的日志都不能做快照
+	if index <= rf.lastIncludedIndex || index > rf.lastApplied {
+		return
+	}
+	DPrintf("Server %d: take a snapshot up to index %d, lastIncludedIndex: %d\n", rf.me, index, rf.lastIncludedIndex)
+	term := rf.getLogTerm(index)
+	rf.snapshotConfig = rf.configAt(index)
+	// 重新分配一份, 让被截掉的日志可以被回收
+	rf.log = append([]Entry{}, rf.log[index-rf.lastIncludedIndex:]...)
+	rf.lastIncludedIndex = index
+	rf.lastIncludedTerm = term
+	rf.persistWithSnapshot(snapshot)
+}
+
 //
 // example code to send a RequestVote RPC to a server.
 // server is the index of the target server in rf.peers[].
@@ -481,13 +715,21 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 // the struct itself.
 //
 func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *RequestVoteReply) bool {
-	ok := rf.peers[server].Call("Raft.RequestVote", args, reply)
-	return ok
+	ok := rf.peer(server).RequestVote(rf.ctx, args, reply)
+	// Kill()之后当作没有收到回复, 不再改变状态
+	return ok && !rf.killed()
 }
 
 func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
-	return ok
+	ok := rf.peer(server).AppendEntries(rf.ctx, args, reply)
+	// Kill()之后当作没有收到回复, 不再改变状态
+	return ok && !rf.killed()
+}
+
+func (rf *Raft) sendInstallSnapshot(server int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
+	ok := rf.peer(server).InstallSnapshot(rf.ctx, args, reply)
+	// Kill()之后当作没有收到回复, 不再改变状态
+	return ok && !rf.killed()
 }
 
 //
@@ -502,42 +744,120 @@ func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *Ap
 // if it's ever committed. the second return value is the current
 // term. the third return value is true if this server believes it is
 // the leader.
-
+//
+// with Options.ForwardProposals set, a follower that knows the leader
+// forwards the command to it and returns the index and term the leader
+// assigned, and true if the leader accepted it. Start() then waits for
+// the leader's reply instead of returning immediately.
+//
+// Start() panics if Options.Codec can't encode the command; use
+// Propose() to get an error instead.
+//
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
+	// 命令在加锁之前编码, 转发给leader的也是编码之后的命令
+	data, err := rf.opts.Codec.Encode(command)
+	if err != nil {
+		panic(fmt.Sprintf("raft: can't encode command %v: %v", command, err))
+	}
 	// 锁进程
 	rf.mu.Lock()
+	index, term, isLeader := rf.start(data)
+	leader := rf.leaderId
+	forward := !isLeader && rf.opts.ForwardProposals && rf.state != Leader && leader != -1 && !rf.killed()
+	// 解锁
+	rf.mu.Unlock()
+	if forward {
+		return rf.forwardProposal(leader, term, data)
+	}
+	return index, term, isLeader
+}
+
+// Start()和Propose()共用, 调用时需要持有rf.mu
+func (rf *Raft) start(data []byte) (int, int, bool) {
 	index := -1
 	term := rf.currentTerm
-	isLeader := (rf.state == Leader)
+	isLeader := (rf.state == Leader) && !rf.killed()
 	// Your code here (2B).
+	// 正在转移领导权时不再接受新的日志, 否则目标server的日志永远追不上
+	if isLeader && rf.transferTarget != -1 {
+		isLeader = false
+	}
 	// 一开始可能会选错leader(比如某个leader失去连接后又恢复(状态还是保持在Leader), 这种情况下会在后续该节点发出心跳包后转为Follower, 在重新确定出Leader后开始一轮新的Start操作)
 	if isLeader {
-		DPrintf("Leader %d: got a new Start task, command: %v\n", rf.me, command)
+		DPrintf("Leader %d: got a new Start task, command: %d bytes\n", rf.me, len(data))
 		// 添加到leader的日志里，同时记录任期号，索引值
-		rf.log = append(rf.log, Entry{rf.currentTerm, command})
-		index = len(rf.log)
+		rf.appendLog(Entry{Term: rf.currentTerm, Type: EntryCommand, Data: data})
+		index = rf.getLastLogIndex()
 		// save Raft's persistent state to stable storage
 		rf.persist()
 	}
-	// 解锁
-	rf.mu.Unlock()
 	// 如果这个raft服务器不是leader，则isleader会返回false，因为leader最先添加日志
 	return index, term, isLeader
 }
 
 //
 // the tester calls Kill() when a Raft instance won't
-// be needed again. you are not required to do anything
-// in Kill(), but it might be convenient to (for example)
-// turn off debug output from this instance.
+// be needed again. Kill() stops the election loop, the
+// heartbeat loop, the applier and every goroutine sending an
+// RPC, and returns once they have all exited; nothing is sent
+// on applyCh and nothing is written to storage after it
+// returns. RPCs already in flight are abandoned: Kill() cancels
+// the context the Transport got with them, and their replies
+// are ignored.
 //
 func (rf *Raft) Kill() {
-	// Your code here, if desired.
+	rf.mu.Lock()
+	if rf.killed() {
+		rf.mu.Unlock()
+		return
+	}
+	DPrintf("Server %d: killed\n", rf.me)
+	atomic.StoreInt32(&rf.dead, 1)
+	close(rf.killCh)
+	// 正在进行的RPC不用再等回复了
+	rf.cancel()
+	rf.abandonProposals(math.MaxInt32, ErrShutdown)
+	// 唤醒正在等待新日志的applier和等待中的读请求
+	rf.applyCond.Broadcast()
+	rf.readCond.Broadcast()
+	rf.mu.Unlock()
+	rf.wg.Wait()
+	rf.timer.Stop()
+}
+
+func (rf *Raft) killed() bool {
+	return atomic.LoadInt32(&rf.dead) == 1
 }
 
+// 日志项的种类
+type EntryType int
+
+const (
+	EntryCommand EntryType = iota // service的命令, Data是Options.Codec编码的结果
+	EntryNoOp                     // 新leader追加的空日志, 见NoOp
+	EntryConfig                   // 配置变更, Data是编码后的Configuration
+)
+
+//
+// a log entry. Data is opaque to everything but Raft's applier, so
+// the log's format doesn't depend on the service's command types.
+//
 type Entry struct {
-	Term    int
-	Command interface{}
+	Term int
+	Type EntryType
+	Data []byte
+}
+
+func configEntry(term int, c Configuration) Entry {
+	return Entry{Term: term, Type: EntryConfig, Data: encodeConfiguration(c)}
+}
+
+// 日志项中的配置, 不是配置变更时ok为false
+func (e Entry) config() (c Configuration, ok bool) {
+	if e.Type != EntryConfig {
+		return c, false
+	}
+	return decodeConfiguration(e.Data), true
 }
 
 //
@@ -546,17 +866,30 @@ type Entry struct {
 // server's port is peers[me]. all the servers' peers[] arrays
 // have the same order. persister is a place for this server to
 // save its persistent state, and also initially holds the most
-// recent saved state, if any. applyCh is a channel on which the
+// recent saved state, if any; use MakeWithOptions() to keep the
+// state in some other Storage. applyCh is a channel on which the
 // tester or service expects Raft to send ApplyMsg messages.
 // Make() must return quickly, so it should start goroutines
-// for any long-running work.
+// for any long-running work. Make() uses DefaultOptions(); see
+// MakeWithOptions() for other settings. Make() panics if the persisted
+// state can't be read; MakeWithOptions() returns an error instead.
 //
 func Make(peers []*labrpc.ClientEnd, me int,
 	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	rf, err := makeRaft(labrpcTransports(peers), me, MakePersisterStorage(persister), applyCh, DefaultOptions())
+	if err != nil {
+		panic(err)
+	}
+	return rf
+}
+
+func makeRaft(peers []Transport, me int,
+	storage Storage, applyCh chan ApplyMsg, opts Options) (*Raft, error) {
 	rf := &Raft{}
 	rf.peers = peers
-	rf.persister = persister
+	rf.storage = storage
 	rf.me = me
+	rf.opts = opts
 
 	// Your initialization code here (2A, 2B, 2C).
 	rf.currentTerm = 0
@@ -567,35 +900,82 @@ func Make(peers []*labrpc.ClientEnd, me int,
 
 	rf.state = Follower
 	rf.applyCh = applyCh
-	rf.electionTimeout = GenerateElectionTimeout(200, 400)
+	rf.electionTimeout = rf.newElectionTimeout()
 	rf.grantVoteCh = make(chan bool)
 	rf.heartBeatCh = make(chan bool)
 	rf.leaderCh = make(chan bool)
-	rf.totalVotes = 0
+	rf.timeoutNowCh = make(chan bool)
+	rf.preVoteCh = make(chan bool)
+	rf.killCh = make(chan struct{})
+	rf.ctx, rf.cancel = context.WithCancel(context.Background())
+	rf.transferTarget = -1
+	rf.leaderId = -1
+	rf.votes = nil
+	rf.lastAck = map[int]time.Time{}
+	rf.replicateCh = map[int]chan bool{}
+	rf.inflight = map[int]int{}
+	rf.installing = map[int]bool{}
+	rf.proposals = map[int]*Future{}
+	// 刚重启的server可能在崩溃前刚确认过leader的心跳, 保守起见当作刚收到过
+	if rf.opts.LeaseRead {
+		rf.lastHeartbeat = time.Now()
+	}
+	rf.config = Configuration{Servers: []int{}}
+	for i := 0; i < len(peers); i++ {
+		if containsServer(opts.InitialLearners, i) {
+			rf.config.Learners = append(rf.config.Learners, i)
+		} else {
+			rf.config.Servers = append(rf.config.Servers, i)
+		}
+	}
+	rf.snapshotConfig = rf.config
 	rf.timer = time.NewTimer(time.Duration(rf.electionTimeout) * time.Millisecond)
 
+	rf.lastIncludedIndex = 0
+	rf.lastIncludedTerm = 0
+	rf.applyCond = sync.NewCond(&rf.mu)
+	rf.readCond = sync.NewCond(&rf.mu)
+
 	// initialize from state persisted before a crash
-	rf.readPersist(persister.ReadRaftState())
+	if err := rf.readPersist(); err != nil {
+		rf.timer.Stop()
+		return nil, err
+	}
+	rf.reloadConfig()
+	// 快照里的日志都是已经apply过的, 重启后先把快照交给service
+	if rf.lastIncludedIndex > 0 {
+		rf.commitIndex = rf.lastIncludedIndex
+		rf.snapshotPending = true
+	}
+	rf.wg.Add(2)
+	go rf.applier()
 	DPrintf("--------------------- Resume server %d persistent state ---------------------\n", rf.me)
 	go func() {
+		defer rf.wg.Done()
 		for {
 			rf.mu.Lock()
 			state := rf.state
 			rf.mu.Unlock()
+			if rf.killed() {
+				return
+			}
 			switch {
 			case state == Leader:
 				DPrintf("Candidate %d: l become leader now!!! Current term is %d\n", rf.me, rf.currentTerm)
 				rf.startAppendEntries()
 			case state == Candidate:
 				DPrintf("================ Candidate %d start election!!! ================\n", rf.me)
+				rf.wg.Add(1)
 				go rf.startRequestVote()
 				select {
 				case <-rf.heartBeatCh:
-					DPrintf("Candidate %d: receive heartbeat when requesting votes, turn back to follower\n", rf.me)
-					rf.mu.Lock()
-					rf.convertToFollower(rf.currentTerm, -1)
-					rf.mu.Unlock()
+					// AppendEntries/InstallSnapshot里已经转为follower了
+					// 仍然是candidate说明这是成为candidate之前收到的心跳留下的信号
+					// (比如领导权转移时紧挨着TimeoutNow的那个心跳), 不能因此放弃选举, 重新请求一遍投票
+					DPrintf("Candidate %d: receive heartbeat when requesting votes\n", rf.me)
 				case <-rf.leaderCh:
+				case <-rf.killCh:
+					return
 				case <-rf.timer.C:
 					rf.mu.Lock()
 					if rf.state == Follower {
@@ -603,14 +983,44 @@ func Make(peers []*labrpc.ClientEnd, me int,
 						rf.mu.Unlock()
 						continue
 					}
-					rf.convertToCandidate()
+					// 开启PreVote时重新从预投票开始, 避免被隔离的candidate不断增加任期
+					if rf.opts.PreVote {
+						rf.convertToPreCandidate()
+					} else {
+						rf.convertToCandidate()
+					}
+					rf.mu.Unlock()
+				}
+			case state == PreCandidate:
+				DPrintf("================ Server %d start pre-vote!!! ================\n", rf.me)
+				rf.wg.Add(1)
+				go rf.startPreVote()
+				select {
+				case <-rf.heartBeatCh:
+					// AppendEntries里已经转为follower了
+					DPrintf("Server %d: receive heartbeat when pre-voting, turn back to follower\n", rf.me)
+				case <-rf.grantVoteCh:
+					rf.mu.Lock()
+					if rf.state == PreCandidate {
+						rf.state = Follower
+					}
+					rf.mu.Unlock()
+				case <-rf.preVoteCh:
+				case <-rf.killCh:
+					return
+				case <-rf.timer.C:
+					rf.mu.Lock()
+					// 预投票没有得到多数派同意, 等下一个选举超时后再试, 任期号不变
+					if rf.state == PreCandidate {
+						rf.convertToPreCandidate()
+					}
 					rf.mu.Unlock()
 				}
 			case state == Follower:
 				rf.mu.Lock()
 				// 必须！比如之前是Leader, 重新连接后转为Follower, 此时rf.timer.C里其实已经有值了
 				rf.drainOldTimer()
-				rf.electionTimeout = GenerateElectionTimeout(200, 400)
+				rf.electionTimeout = rf.newElectionTimeout()
 				rf.timer.Reset(time.Duration(rf.electionTimeout) * time.Millisecond)
 				rf.mu.Unlock()
 				select {
@@ -618,10 +1028,28 @@ func Make(peers []*labrpc.ClientEnd, me int,
 					DPrintf("Server %d: reset election time due to grantVote\n", rf.me)
 				case <-rf.heartBeatCh:
 					DPrintf("Server %d: reset election time due to heartbeat\n", rf.me)
+				case <-rf.timeoutNowCh:
+					rf.mu.Lock()
+					// leader要把领导权交给自己, 不用等选举超时
+					if rf.state == Follower && rf.currentTerm == rf.timeoutNowTerm && rf.config.isVoter(rf.me) {
+						DPrintf("Server %d: got TimeoutNow, turn to candidate\n", rf.me)
+						rf.convertToCandidate()
+						rf.transferElection = true
+					}
+					rf.mu.Unlock()
+				case <-rf.killCh:
+					return
 				case <-rf.timer.C:
-					DPrintf("Server %d: election timeout, turn to candidate\n", rf.me)
 					rf.mu.Lock()
-					rf.convertToCandidate()
+					// 不在集群配置中的server(比如已经被移除)不能发起选举
+					if rf.config.isVoter(rf.me) {
+						DPrintf("Server %d: election timeout, turn to candidate\n", rf.me)
+						if rf.opts.PreVote {
+							rf.convertToPreCandidate()
+						} else {
+							rf.convertToCandidate()
+						}
+					}
 					rf.mu.Unlock()
 				}
 			}
@@ -629,7 +1057,7 @@ func Make(peers []*labrpc.ClientEnd, me int,
 		}
 	}()
 
-	return rf
+	return rf, nil
 }
 
 func GenerateElectionTimeout(min, max int) int {
@@ -639,6 +1067,7 @@ func GenerateElectionTimeout(min, max int) int {
 }
 
 func (rf *Raft) startRequestVote() {
+	defer rf.wg.Done()
 	DPrintf("Candidate %d: start sending RequestVote, current log: %v, current term: %d\n", rf.me, rf.log, rf.currentTerm)
 	// 很有必要进行这个判断
 	// 一种情况是Candidate在开启startRequestVote后, 就收到心跳包转为Follower, 因此再发送requestVote请求前有必要再判断一下
@@ -647,25 +1076,30 @@ func (rf *Raft) startRequestVote() {
 		rf.mu.Unlock()
 		return
 	}
-	lastLogIndex := len(rf.log)
-	lastLogTerm := 0
-	if lastLogIndex > 0 {
-		lastLogTerm = rf.log[lastLogIndex-1].Term
-	}
+	lastLogIndex := rf.getLastLogIndex()
+	lastLogTerm := rf.getLastLogTerm()
 	args := RequestVoteArgs{
 		Term:         rf.currentTerm,
 		CandidateId:  rf.me,
 		LastLogIndex: lastLogIndex,
 		LastLogTerm:  lastLogTerm,
+		// 领导权转移时旧leader已经不再服务租约读了
+		LeadershipTransfer: rf.transferElection,
 	}
 	nLeader := 0
+	// 只向当前配置中的成员请求投票
+	members := rf.config.members()
 	rf.mu.Unlock()
-	for i := 0; i < len(rf.peers); i++ {
+	for _, server := range members {
+		// 这里还在rf.wg里, 不会在Kill()等待的时候Add
+		rf.wg.Add(1)
 		go func(ii int) {
+			defer rf.wg.Done()
 			if ii == rf.me {
 				return
 			}
 			reply := RequestVoteReply{}
+			sent := time.Now()
 			ok := rf.sendRequestVote(ii, &args, &reply)
 			if ok {
 				rf.mu.Lock()
@@ -683,8 +1117,10 @@ func (rf *Raft) startRequestVote() {
 				}
 
 				if reply.VoteGranted {
-					rf.totalVotes++
-					if nLeader == 0 && rf.totalVotes > len(rf.peers)/2 && rf.state == Candidate {
+					rf.votes[ii] = true
+					rf.recordAck(ii, sent)
+					// 联合共识期间需要同时得到C_old和C_new的多数派
+					if nLeader == 0 && rf.config.quorum(func(server int) bool { return rf.votes[server] }) && rf.state == Candidate {
 						nLeader++
 						rf.convertToLeader()
 						// 之前一个找了好久的bug: setLeaderCh里没有启一个新的goroutine, 可能导致阻塞, 进而造成死锁
@@ -695,7 +1131,110 @@ func (rf *Raft) startRequestVote() {
 			} else {
 				DPrintf("Candidate %d: sending RequestVote to server %d failed\n", rf.me, ii)
 			}
-		}(i)
+		}(server)
+	}
+}
+
+// 预投票: 只有多数派认为自己能赢得选举时才真正增加任期成为candidate
+// 这样被隔离的server重新连上时不会因为任期更大而让正常工作的leader下台
+func (rf *Raft) startPreVote() {
+	defer rf.wg.Done()
+	rf.mu.Lock()
+	if rf.state != PreCandidate {
+		rf.mu.Unlock()
+		return
+	}
+	term := rf.currentTerm
+	args := RequestVoteArgs{
+		Term:         rf.currentTerm + 1,
+		CandidateId:  rf.me,
+		LastLogIndex: rf.getLastLogIndex(),
+		LastLogTerm:  rf.getLastLogTerm(),
+		PreVote:      true,
+	}
+	members := rf.config.members()
+	rf.mu.Unlock()
+	for _, server := range members {
+		rf.wg.Add(1)
+		go func(ii int) {
+			defer rf.wg.Done()
+			if ii == rf.me {
+				return
+			}
+			reply := RequestVoteReply{}
+			if !rf.sendRequestVote(ii, &args, &reply) {
+				DPrintf("Server %d: sending pre-vote to server %d failed\n", rf.me, ii)
+				return
+			}
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+			if reply.Term > rf.currentTerm {
+				rf.convertToFollower(reply.Term, -1)
+				return
+			}
+			if rf.currentTerm != term || rf.state != PreCandidate {
+				return
+			}
+			if reply.VoteGranted {
+				rf.votes[ii] = true
+				if rf.config.quorum(func(server int) bool { return rf.votes[server] }) {
+					DPrintf("Server %d: won the pre-vote, start a real election\n", rf.me)
+					rf.convertToCandidate()
+					rf.setPreVoteCh()
+				}
+			}
+		}(server)
+	}
+}
+
+// 处理预投票请求, 不修改任何状态: 不更新任期, 不记录投票, 也不重置选举超时
+func (rf *Raft) handlePreVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	reply.Term = rf.currentTerm
+	reply.VoteGranted = false
+	// 发起预投票的server即使当选, 任期也不会比我大
+	if args.Term <= rf.currentTerm {
+		return
+	}
+	// 我是leader, 或者最近一个选举超时内还收到过leader的心跳, 说明leader还活着, 不需要选举
+	if rf.state == Leader || time.Since(rf.lastHeartbeat) < rf.opts.ElectionTimeoutMin {
+		return
+	}
+	reply.VoteGranted = rf.isLogUpToDate(args.LastLogIndex, args.LastLogTerm)
+}
+
+// 候选人的日志是否至少和自己的一样新
+func (rf *Raft) isLogUpToDate(lastLogIndex int, lastLogTerm int) bool {
+	if lastLogTerm != rf.getLastLogTerm() {
+		return lastLogTerm > rf.getLastLogTerm()
+	}
+	return lastLogIndex >= rf.getLastLogIndex()
+}
+
+//
+// return true if this server is the leader and a majority of the
+// cluster has acknowledged it within the last election timeout.
+// services can use it to reject requests on a leader that has
+// been partitioned away.
+//
+func (rf *Raft) HasQuorum() bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.state == Leader && rf.hasQuorumSince(time.Now().Add(-rf.opts.ElectionTimeoutMax))
+}
+
+// 是否有多数派在since之后确认过自己的领导地位, 调用时需要持有rf.mu
+// 记录的是RPC的发送时间而不是收到回复的时间, 这样follower确认的时候一定还认可这个leader
+func (rf *Raft) hasQuorumSince(since time.Time) bool {
+	return rf.config.quorum(func(server int) bool {
+		return server == rf.me || !rf.lastAck[server].Before(since)
+	})
+}
+
+// 记录server对当前任期的确认, 调用时需要持有rf.mu
+func (rf *Raft) recordAck(server int, sent time.Time) {
+	if sent.After(rf.lastAck[server]) {
+		rf.lastAck[server] = sent
+		rf.readCond.Broadcast()
 	}
 }
 
@@ -707,233 +1246,219 @@ func (rf *Raft) startAppendEntries() {
 		// 常规来说只有状态为leader的raft服务器才能startAppendEntries
 		// 但在ReJoin2B测试中，Leader状态可能会变为Follower
 		// follower不能发送AppendEntries（heartBeat）
-		if rf.state != Leader {
+		if rf.state != Leader || rf.killed() {
 			rf.mu.Unlock()
 			return
 		}
-		DPrintf("Leader %d: start sending AppendEntries, current term: %d\n", rf.me, rf.currentTerm)
-		rf.mu.Unlock()
-		for i := 0; i < len(rf.peers); i++ {
-			// heartBeat不发给leader自己
-			go func(ii int) {
-				if ii == rf.me {
-					return
-				}
-
-				for {
-					rf.mu.Lock()
-					// 如果leader断开了，虽然心跳包发送不会成功，但会在循环中保持发送心跳包，
-					// 重新连上的时候任期已经过了，接收到了新leader的心跳包，转化为follower了。
-					// follower不能发送AppendEntries（heartBeat），返回
-					if rf.state != Leader {
-						rf.mu.Unlock()
-						return
-					}
-					// 发给follower：ii的最后一条日志项的索引
-					prevLogIndex := rf.nextIndex[ii] - 1
-					// 还没给follower：ii发过日志，则没有prevLog，任期号也就是0
-					prevLogTerm := 0
-					if prevLogIndex > 0 {
-						// 找到prevLog的任期号
-						prevLogTerm = rf.log[prevLogIndex-1].Term
-					}
-					// 从已经发送完的最后一条日志项开始，剩余的日志项都发送给follower：ii
-					entries := append([]Entry{}, rf.log[rf.nextIndex[ii]-1:]...)
-					// 发送参数
-					args := AppendEntriesArgs{
-						Term:         rf.currentTerm,
-						LeaderId:     rf.me,
-						PrevLogIndex: prevLogIndex,
-						PrevLogTerm:  prevLogTerm,
-						Entries:      entries,
-						LeaderCommit: rf.commitIndex,
-					}
-					// 接收反馈信息的结构体
-					reply := AppendEntriesReply{}
-					rf.mu.Unlock()
-					// 发送
-					ok := rf.sendAppendEntries(ii, &args, &reply)
-					// DPrintf("Leader %d: send heartbeat to server %d, got reply:%v\n", rf.me, ii, reply)
-					// 如果ok==false, 代表心跳包没发送出去, 有两种可能: 1. 该Leader失去连接 2. 接受心跳包的Follower失去连接
-					// 如果是可能性1, 那么发送出去的所有心跳包会不成功, 但不会退出, 会一直发送。 当再次连接上的时候, 由于任期肯定小于其他服务器, 因此会退出循环, 变为Follower
-					// 如果是可能性2, 不影响, 继续发送心跳包给其他连接上的服务器
-					// 由上面的分析, 可知不需要对isok == false做特殊处理
-					if ok {
-						rf.mu.Lock()
-						// 知道自己不是最新的leader了
-						if reply.Term > rf.currentTerm {
-							// 退出循环, 转换为follower
-							DPrintf("Leader %d: turn back to follower due to existing higher term %d from server %d\n", rf.me, reply.Term, ii)
-							rf.convertToFollower(reply.Term, -1)
-							rf.mu.Unlock()
-							return
-						}
-						// 进行这一步判断很有必要, 比如两个goroutine先后进入这个if ok {}判断, 第一个goroutine得到的reply.Term > rf.currentTerm从而转换为Follower并更新了currentTerm
-						// 如果不进行这个判断, 那么第二个goroutine在进行reply.Term > rf.currentTerm判断时会有reply.Term == rf.currentTerm，导致错误地进行后续流程
-						if rf.currentTerm != args.Term || rf.state != Leader {
-							rf.mu.Unlock()
-							return
-						}
-						// 成功同步了follower：ii
-						if reply.Success == true {
-							// 虽然暂时这样写没啥问题, 但根据students-guide-to-raft中分析可知这行代码并不安全(This is not safe because those values could have been updated since when you sent the RPC)
-							// 所以改成更新完matchIndex再更新nextIndex
-							// rf.nextIndex[ii] = len(rf.log) + 1
-							// follower:ii中和leader的log可以匹配的日志的最高索引
-							rf.matchIndex[ii] = prevLogIndex + len(entries)
-							// 那下一个要发给 follower:ii的日志的起始位置就是matchIndex[ii] + 1
-							rf.nextIndex[ii] = rf.matchIndex[ii] + 1
-							// paper中Figure 8的情形, 这个实现很妙!
-							// 拷贝leader的matchIndex列表
-							// matchIndex:leader记录的各个server已提交的最大日志索引
-							copyMatchIndex := make([]int, len(rf.peers))
-							copy(copyMatchIndex, rf.matchIndex)
-							copyMatchIndex[rf.me] = len(rf.log)
-							// 按已经提交的最大日志索引排序
-							sort.Ints(copyMatchIndex)
-							// N：超半数的server已经提交的日志项
-							N := copyMatchIndex[len(rf.peers)/2]
-							// N大于leader已经提交的最大日志项索引
-							// 并且索引为N的日志项和leader的任期号是一致的
-							// leader更新自己要提交的日志索引值
-							if N > rf.commitIndex && rf.log[N-1].Term == rf.currentTerm {
-								rf.commitIndex = N
-							}
-							DPrintf("Leader %d: start applying logs, lastApplied: %d, commitIndex: %d\n", rf.me, rf.lastApplied, rf.commitIndex)
-							// leader执行提交日志项，直到索引为commitIndex的日志
-							rf.startApplyLogs()
-							rf.mu.Unlock()
-							return
-						} else { // 没有成功同步follower：ii
-							// 优化逻辑
-							hasTermEuqalConflictTerm := false
-							for i := 0; i < len(rf.log); i++ {
-								if rf.log[i].Term == reply.ConflictTerm {
-									// 在leader中有日志项和follower ii的prev位置的日志项任期号是相同的
-									hasTermEuqalConflictTerm = true
-								}
-								// 该日志项的任期号大于follower ii的prev位置的日志项任期号
-								// 说明该日志项是follower ii还没有的，
-								// 因为follower ii的prev位置的日志项任期号已经是follower最大的任期号了
-								if rf.log[i].Term > reply.ConflictTerm {
-									// 在该log之前的日志项中有和follower ii的prev位置的日志项任期号是相同的
-									if hasTermEuqalConflictTerm {
-										// 下一个要发送给follower ii的就是leader的该条日志
-										// 示例：
-										// fol.logs =    1 1 1 2 2(prev)
-										// leader.logs = 1 1 1 2 3(prev) 3 3 ...
-										// 要发的entries          3       3 3 ...
-										rf.nextIndex[ii] = i
-									} else { // 对应的是follower ii prevIndex位置还没日志的情况,ConflictTerm为-1
-										// 下一个要发送给follower ii的是follower ii的len(log)位置的日志项
-										// 示例
-										// fol.logs =      x x
-										// leader.logs =   x x x prev x n x
-										// args.entries =             x n x
-										// 要发的entries为：     x prev x n x
-										rf.nextIndex[ii] = reply.ConflictIndex
-									}
-									break
-								}
-								// 不存在follower有日志项任期号比leader还大的情况
-							}
-							// nextIndex[ii]不能小于1
-							if rf.nextIndex[ii] < 1 {
-								rf.nextIndex[ii] = 1
-							}
-							rf.mu.Unlock()
-						}
-					} else { //leader发送心跳包失败
-						DPrintf("Leader %d: sending AppendEntries to server %d failed\n", rf.me, ii)
-						return
-					}
-				}
-			}(i)
+		// CheckQuorum: 一个选举超时内都没有得到多数派的回复, 说明自己很可能已经被隔离了
+		// 继续当leader只会让客户端的请求一直挂着, 主动退位
+		if rf.opts.CheckQuorum && !rf.hasQuorumSince(time.Now().Add(-rf.opts.ElectionTimeoutMax)) {
+			DPrintf("Leader %d: lost contact with a quorum, step down\n", rf.me)
+			rf.stepDown()
+			rf.mu.Unlock()
+			return
 		}
+		// 日志和心跳由每个follower各自的replicator发送(见replication.go)
+		// 这里只需要给配置变更新加入的server启动replicator
+		rf.startReplicators()
+		rf.mu.Unlock()
 		// 一开始设置为50ms, 会导致2C中最后三个test有一定概率不过
 		// 两种比较好的参数设置:
 		// a. 选举超时: 150ms-300ms, 领导者心跳: 50ms
 		// b. 选举超时: 200ms-400ms, 领导者心跳: 100ms
 		// ref: https://github.com/springfieldking/mit-6.824-golabs-2018/issues/1
 		// 心跳包发送间隙
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-rf.killCh:
+			return
+		case <-time.After(rf.opts.HeartbeatInterval):
+		}
 	}
 }
 
+// 通知applier有新的日志可以apply, 调用时需要持有rf.mu
 func (rf *Raft) startApplyLogs() {
-	// 原先写的是rf.lastApplied = len(rf.log)会很有问题, 错误地认为每次提交都会把所有日志提交完, 其实可能只提交一部分
-	// 执行未执行的cmd，执行到提交的最新的日志
-	for rf.lastApplied < rf.commitIndex {
-		rf.lastApplied++
-		// 所谓执行命令，就是把命令放进rpc的msg，
-		// msg传到config进行记录统计
-		// config.logs[server][index]，记录每个server已经提交的日志项
+	rf.applyCond.Broadcast()
+	// commitIndex可能前进了
+	rf.readCond.Broadcast()
+}
+
+// applier在单独的goroutine里把已提交的日志按顺序交给service
+// 发送applyCh时不持有锁, service因此可以在读applyCh的goroutine里调用Snapshot()等方法
+func (rf *Raft) applier() {
+	defer rf.wg.Done()
+	for {
+		rf.mu.Lock()
+		for !rf.snapshotPending && rf.lastApplied >= rf.commitIndex && !rf.killed() {
+			rf.applyCond.Wait()
+		}
+		if rf.killed() {
+			rf.mu.Unlock()
+			return
+		}
 		msg := ApplyMsg{}
-		msg.Index = rf.lastApplied
-		msg.Command = rf.log[rf.lastApplied-1].Command
-		rf.applyCh <- msg
+		term := -1
+		if rf.snapshotPending {
+			// 快照覆盖了还没apply的日志, 直接跳到快照的位置
+			rf.snapshotPending = false
+			if rf.lastApplied < rf.lastIncludedIndex {
+				rf.lastApplied = rf.lastIncludedIndex
+			}
+			msg.Index = rf.lastIncludedIndex
+			msg.UseSnapshot = true
+			msg.Snapshot = rf.readSnapshot()
+		} else {
+			// 原先写的是rf.lastApplied = len(rf.log)会很有问题, 错误地认为每次提交都会把所有日志提交完, 其实可能只提交一部分
+			// 执行未执行的cmd，执行到提交的最新的日志
+			// 所谓执行命令，就是把命令放进rpc的msg，
+			// msg传到config进行记录统计
+			// config.logs[server][index]，记录每个server已经提交的日志项
+			rf.lastApplied++
+			msg.Index = rf.lastApplied
+			entry := rf.getLogEntry(rf.lastApplied)
+			term = entry.Term
+			var err error
+			if msg.Command, msg.Internal, err = rf.decodeEntry(entry); err != nil {
+				// 已经提交的命令解码不了, 继续apply后面的命令会让service的状态出错
+				panic(fmt.Sprintf("raft: server %d can't decode the command at index %d: %v", rf.me, msg.Index, err))
+			}
+		}
+		rf.mu.Unlock()
+		// service可能已经不再读applyCh了, 不能一直阻塞在这里
+		select {
+		case rf.applyCh <- msg:
+		case <-rf.killCh:
+			return
+		}
+		rf.mu.Lock()
+		rf.deliveredIndex = msg.Index
+		rf.readCond.Broadcast()
+		if !msg.UseSnapshot {
+			rf.proposalApplied(msg.Index, term)
+		}
+		rf.mu.Unlock()
 	}
 }
 
 func (rf *Raft) convertToFollower(term int, voteFor int) {
+	// leader退位, 它提出的命令结果未知
+	if rf.state == Leader {
+		rf.proposalsOrphaned()
+	}
+	// 进入新的任期或者自己退位, 都不再知道谁是leader
+	if term != rf.currentTerm || rf.state == Leader {
+		rf.leaderId = -1
+	}
 	// 更新自己知道的leader的任期号
 	rf.currentTerm = term
 	// 状态变为follower
 	rf.state = Follower
 	// follower是0票
-	rf.totalVotes = 0
+	rf.votes = nil
 	// leader的id
 	rf.votedFor = voteFor
 	rf.persist()
+	// 等待确认领导地位的读请求不用再等了
+	rf.readCond.Broadcast()
+}
+
+// 在当前任期内变回follower. 这个任期已经投过票(投给了自己),
+// votedFor必须保留, 否则可能在同一个任期里再投给别人, 选出两个leader
+func (rf *Raft) stepDown() {
+	rf.convertToFollower(rf.currentTerm, rf.votedFor)
 }
 
 func (rf *Raft) convertToCandidate() {
 	rf.state = Candidate
 	rf.currentTerm++
 	rf.votedFor = rf.me
-	rf.totalVotes = 1
-	rf.electionTimeout = GenerateElectionTimeout(200, 400)
+	rf.leaderId = -1
+	rf.votes = map[int]bool{rf.me: true}
+	rf.transferElection = false
+	// 新的任期, 之前的确认都不再算数
+	rf.lastAck = map[int]time.Time{}
+	rf.electionTimeout = rf.newElectionTimeout()
 	rf.timer.Reset(time.Duration(rf.electionTimeout) * time.Millisecond)
 	rf.persist()
 }
 
+// 预投票阶段不增加任期, 也不给自己投票, 所以不需要持久化
+func (rf *Raft) convertToPreCandidate() {
+	rf.state = PreCandidate
+	rf.votes = map[int]bool{rf.me: true}
+	rf.electionTimeout = rf.newElectionTimeout()
+	rf.timer.Reset(time.Duration(rf.electionTimeout) * time.Millisecond)
+}
+
 func (rf *Raft) convertToLeader() {
 	rf.state = Leader
-	rf.nextIndex = make([]int, len(rf.peers))
-	rf.matchIndex = make([]int, len(rf.peers))
-	for i := 0; i < len(rf.peers); i++ {
-		rf.nextIndex[i] = len(rf.log) + 1
-		rf.matchIndex[i] = 0
+	rf.leaderId = rf.me
+	rf.transferTarget = -1
+	// 上一次当leader时的replicator会因为任期不同自己退出
+	rf.replicateCh = map[int]chan bool{}
+	rf.nextIndex = map[int]int{}
+	rf.matchIndex = map[int]int{}
+	for _, server := range rf.replicaTargets() {
+		rf.nextIndex[server] = rf.getLastLogIndex() + 1
+		rf.matchIndex[server] = 0
+	}
+	if rf.configIndex > rf.commitIndex {
+		// 上一任leader留下了未提交的配置, 之前任期的日志不能直接提交,
+		// 用当前任期重新追加一次同样的配置, 让配置变更可以继续进行
+		rf.appendLog(configEntry(rf.currentTerm, rf.config))
+		rf.persist()
+	} else {
+		// 上一任leader可能在联合配置提交后、追加C_new之前就下台了
+		rf.advanceConfig()
+	}
+	// 之前任期的日志只能随着当前任期的日志一起提交(Figure 8),
+	// 如果一直没有客户端调用Start, 它们就一直提交不了, 所以先追加一条空日志
+	// NoOp会通过applyCh交给service, ApplyMsg.Internal为true
+	if rf.getLastLogTerm() != rf.currentTerm {
+		DPrintf("Leader %d: append no-op entry, current term: %d\n", rf.me, rf.currentTerm)
+		rf.appendLog(Entry{Term: rf.currentTerm, Type: EntryNoOp})
+		rf.persist()
 	}
+	rf.startReplicators()
 }
 
 func (rf *Raft) setHeartBeatCh() {
-	go func() {
-		select {
-		case <-rf.heartBeatCh:
-		default:
-		}
-		rf.heartBeatCh <- true
-	}()
+	rf.signal(rf.heartBeatCh)
 }
 
 func (rf *Raft) setGrantVoteCh() {
-	go func() {
-		select {
-		case <-rf.grantVoteCh:
-		default:
-		}
-		rf.grantVoteCh <- true
-	}()
+	rf.signal(rf.grantVoteCh)
 }
 
 func (rf *Raft) setLeaderCh() {
+	rf.signal(rf.leaderCh)
+}
+
+func (rf *Raft) setTimeoutNowCh() {
+	rf.signal(rf.timeoutNowCh)
+}
+
+func (rf *Raft) setPreVoteCh() {
+	rf.signal(rf.preVoteCh)
+}
+
+// 在新的goroutine里清空ch再发送一个信号, 这样不会阻塞调用者
+// Kill()之后主循环不再读取, goroutine直接退出. 调用时需要持有rf.mu
+func (rf *Raft) signal(ch chan bool) {
+	if rf.killed() {
+		return
+	}
+	rf.wg.Add(1)
 	go func() {
+		defer rf.wg.Done()
 		select {
-		case <-rf.leaderCh:
+		case <-ch:
 		default:
 		}
-		rf.leaderCh <- true
+		select {
+		case ch <- true:
+		case <-rf.killCh:
+		}
 	}()
 }
 
@@ -944,3 +1469,104 @@ func (rf *Raft) drainOldTimer() {
 	default:
 	}
 }
+
+// 日志压缩之后rf.log不再从索引1开始, 日志索引的换算都通过下面几个函数完成
+
+// 最后一条日志的索引, 没有日志时为lastIncludedIndex
+func (rf *Raft) getLastLogIndex() int {
+	return rf.lastIncludedIndex + len(rf.log)
+}
+
+func (rf *Raft) getLastLogTerm() int {
+	return rf.getLogTerm(rf.getLastLogIndex())
+}
+
+// index处日志的任期号, index必须在[lastIncludedIndex, getLastLogIndex()]之间
+func (rf *Raft) getLogTerm(index int) int {
+	if index == rf.lastIncludedIndex {
+		return rf.lastIncludedTerm
+	}
+	return rf.log[index-rf.lastIncludedIndex-1].Term
+}
+
+// index处的日志, index必须在(lastIncludedIndex, getLastLogIndex()]之间
+func (rf *Raft) getLogEntry(index int) Entry {
+	return rf.log[index-rf.lastIncludedIndex-1]
+}
+
+//
+// 交给service的命令: service的命令用Options.Codec解码, raft自己追加的日志
+// (NoOp和配置)还原成NoOp{}和Configuration, internal为true, service应当忽略
+//
+func (rf *Raft) decodeEntry(e Entry) (command interface{}, internal bool, err error) {
+	switch e.Type {
+	case EntryNoOp:
+		return NoOp{}, true, nil
+	case EntryConfig:
+		c, _ := e.config()
+		return c, true, nil
+	}
+	command, err = rf.opts.Codec.Decode(e.Data)
+	return command, false, err
+}
+
+// 从index开始要发给follower的日志, 受MaxEntriesPerRPC和MaxBytesPerRPC限制, 但至少有一条
+// index必须在(lastIncludedIndex, getLastLogIndex()+1]之间
+func (rf *Raft) entriesFrom(index int) []Entry {
+	rest := rf.log[index-rf.lastIncludedIndex-1:]
+	n := len(rest)
+	if rf.opts.MaxEntriesPerRPC > 0 && n > rf.opts.MaxEntriesPerRPC {
+		n = rf.opts.MaxEntriesPerRPC
+	}
+	if rf.opts.MaxBytesPerRPC > 0 {
+		size := 0
+		for i := 0; i < n; i++ {
+			size += entrySize(rest[i])
+			if size > rf.opts.MaxBytesPerRPC && i > 0 {
+				n = i
+				break
+			}
+		}
+	}
+	return append([]Entry{}, rest[:n]...)
+}
+
+// 日志项gob编码后的大小
+func entrySize(e Entry) int {
+	w := new(bytes.Buffer)
+	gob.NewEncoder(w).Encode(&e)
+	return w.Len()
+}
+
+// 在日志末尾追加日志, 新日志中有配置时立即切换到最新的配置
+func (rf *Raft) appendLog(entries ...Entry) {
+	rf.log = append(rf.log, entries...)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if c, ok := entries[i].config(); ok {
+			rf.setConfig(c, rf.getLastLogIndex()-len(entries)+i+1)
+			break
+		}
+	}
+	// leader有了新日志, 立即唤醒replicator发出去, 不用等下一次心跳
+	if rf.state == Leader {
+		rf.startReplicators()
+		rf.triggerReplication()
+	}
+}
+
+// 丢弃index之后的所有日志, 保留index处的日志
+func (rf *Raft) truncateLog(index int) {
+	rf.log = rf.log[:index-rf.lastIncludedIndex]
+	rf.proposalsTruncated(index)
+	// 最新的配置被截掉了, 回退到之前的配置
+	if rf.configIndex > index {
+		rf.reloadConfig()
+	}
+}
+
+// server的Transport, 可能被AddPeer()修改所以需要加锁读取
+func (rf *Raft) peer(server int) Transport {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.peers[server]
+}
@@ -0,0 +1,123 @@
+package raft
+
+//
+// 只读请求的线性一致读(博士论文6.4节的ReadIndex).
+//
+// 读请求不需要写进日志: leader记下当前的commitIndex作为readIndex,
+// 再确认一次自己仍然被多数派认可(没有更新的leader提交过日志),
+// 等到状态机apply到readIndex之后, 在状态机上读到的就是最新的值.
+// 刚当选的leader可能还不知道哪些日志已经提交了, 只有在当前任期
+// 提交过日志之后, commitIndex才一定不小于之前任何leader提交的日志.
+//
+// 租约读(博士论文6.4.1节)省掉了确认领导地位的那一轮心跳: follower在
+// 收到leader的消息之后的一个最小选举超时内不会给别人投票, 所以leader
+// 从多数派确认的心跳的发送时间算起, 在最小选举超时减去时钟误差之内
+// 一定还是唯一的leader, 可以直接用commitIndex服务读请求.
+//
+
+import "time"
+
+//
+// get an index that a linearizable read can be served at. the leader
+// records its commitIndex, confirms with a round of heartbeats that a
+// majority still accepts it, and then waits until that index has been
+// applied, so that once ReadIndex() returns the service can answer the
+// read from its state machine. returns false if this server isn't the
+// leader, loses leadership while confirming, or hasn't committed an
+// entry in its current term within one election timeout (a new leader
+// commits its no-op right away, so the caller can usually just retry).
+//
+func (rf *Raft) ReadIndex() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != Leader {
+		return -1, false
+	}
+	term := rf.currentTerm
+	timeout := time.Duration(rf.electionTimeout) * time.Millisecond
+	stillLeader := func() bool { return rf.state == Leader && rf.currentTerm == term }
+
+	// 1、等待当前任期提交一条日志, 这之后commitIndex才是可靠的
+	committed := rf.waitRead(time.Now().Add(timeout), func() bool {
+		return !stillLeader() || rf.getLogTerm(rf.commitIndex) == term
+	})
+	if !committed || !stillLeader() {
+		return -1, false
+	}
+	readIndex := rf.commitIndex
+
+	// 2、确认领导地位: 立即发一轮心跳, 等待多数派回复在记下readIndex之后发出的心跳
+	// 如果期间出现了更新的leader, 多数派不会再回复这个任期的心跳
+	start := time.Now()
+	rf.broadcastHeartbeat()
+	confirmed := rf.waitRead(start.Add(timeout), func() bool {
+		return !stillLeader() || rf.hasQuorumSince(start)
+	})
+	if !confirmed || !stillLeader() {
+		DPrintf("Leader %d: ReadIndex couldn't confirm leadership, term: %d\n", rf.me, term)
+		return -1, false
+	}
+
+	// 3、等待service从applyCh收到readIndex处的日志, 这一步不再需要自己仍然是leader
+	return readIndex, rf.waitDelivered(readIndex)
+}
+
+//
+// like ReadIndex(), but without a round of heartbeats: succeeds only
+// if Options.LeaseRead is set and the leader holds a lease, i.e. a
+// majority acknowledged heartbeats it sent within the last minimum
+// election timeout minus the clock drift. otherwise returns false and
+// the caller should fall back to ReadIndex().
+//
+func (rf *Raft) LeaseRead() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	// 领导权转移期间新leader可能在租约到期之前就当选, 不能再用租约
+	if !rf.opts.LeaseRead || rf.state != Leader || rf.transferTarget != -1 {
+		return -1, false
+	}
+	if rf.getLogTerm(rf.commitIndex) != rf.currentTerm || !rf.hasQuorumSince(time.Now().Add(-rf.leaseDuration())) {
+		return -1, false
+	}
+	readIndex := rf.commitIndex
+	return readIndex, rf.waitDelivered(readIndex)
+}
+
+// 等待service从applyCh收到index处的日志, Kill()之后返回false, 调用时需要持有rf.mu
+func (rf *Raft) waitDelivered(index int) bool {
+	return rf.waitRead(time.Time{}, func() bool { return rf.deliveredIndex >= index })
+}
+
+// 在readCond上等待done()成立, 超过deadline(零值表示不限时)或者Kill()之后返回false
+// 调用时需要持有rf.mu, 等待期间会释放
+func (rf *Raft) waitRead(deadline time.Time, done func() bool) bool {
+	if !deadline.IsZero() {
+		// 到期时唤醒一次, 让下面的循环看到已经超时
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			rf.mu.Lock()
+			rf.readCond.Broadcast()
+			rf.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for !done() {
+		if rf.killed() || (!deadline.IsZero() && !time.Now().Before(deadline)) {
+			return false
+		}
+		rf.readCond.Wait()
+	}
+	return true
+}
+
+// 租约的长度: 最小选举超时减去时钟误差
+func (rf *Raft) leaseDuration() time.Duration {
+	return rf.opts.ElectionTimeoutMin - rf.opts.ClockDrift
+}
+
+// 自己是否认为当前leader的租约还有效, 调用时需要持有rf.mu
+func (rf *Raft) inLeaderLease() bool {
+	if rf.state == Leader {
+		return rf.hasQuorumSince(time.Now().Add(-rf.leaseDuration()))
+	}
+	return time.Since(rf.lastHeartbeat) < rf.opts.ElectionTimeoutMin
+}
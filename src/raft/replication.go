@@ -0,0 +1,324 @@
+package raft
+
+//
+// leader到follower的日志复制.
+//
+// leader给每个follower启动一个replicator goroutine, 不再是每次心跳才发一轮:
+// Start()追加日志之后立即唤醒所有replicator, 新日志马上就会发出去.
+// 发出一个携带日志的AppendEntries之后, 乐观地把nextIndex推进到这批日志之后,
+// 不等回复就可以接着发下一批(流水线), 每个follower同时最多有MaxInflightRPCs个.
+// 日志对不上或者RPC失败时再把nextIndex退回去重发.
+// 每个AppendEntries最多携带MaxEntriesPerRPC条/MaxBytesPerRPC字节的日志,
+// 连续的多个Start()因此会被合并到同一个RPC里.
+// 一个心跳间隔内没有给follower发过RPC时, 发送一个不带日志的心跳.
+//
+
+import "time"
+
+// 给还没有replicator的follower启动replicator, 调用时需要持有rf.mu
+func (rf *Raft) startReplicators() {
+	if rf.state != Leader || rf.killed() {
+		return
+	}
+	for _, server := range rf.replicaTargets() {
+		if _, ok := rf.replicateCh[server]; ok {
+			continue
+		}
+		// 容量为1, 唤醒多次和唤醒一次是一样的
+		ch := make(chan bool, 1)
+		rf.replicateCh[server] = ch
+		rf.wg.Add(1)
+		go rf.replicator(server, rf.currentTerm, ch)
+	}
+}
+
+// 唤醒所有replicator, 调用时需要持有rf.mu
+func (rf *Raft) triggerReplication() {
+	for _, ch := range rf.replicateCh {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+// 让所有replicator立即给各自的follower发一个AppendEntries(没有新日志时就是心跳), 调用时需要持有rf.mu
+func (rf *Raft) broadcastHeartbeat() {
+	rf.heartbeatAfter = time.Now()
+	rf.triggerReplication()
+}
+
+// 唤醒server的replicator, 调用时需要持有rf.mu
+func (rf *Raft) triggerReplicator(server int) {
+	if ch, ok := rf.replicateCh[server]; ok {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+// 在term任期内负责把日志复制到server, 不再是这个任期的leader或者server被移出集群后退出
+func (rf *Raft) replicator(server int, term int, ch chan bool) {
+	defer rf.wg.Done()
+	// 最近一次给server发RPC的时间
+	lastSend := time.Time{}
+	for {
+		rf.mu.Lock()
+		if rf.killed() || rf.state != Leader || rf.currentTerm != term || rf.replicateCh[server] != ch {
+			rf.mu.Unlock()
+			return
+		}
+		if !containsServer(rf.replicaTargets(), server) {
+			delete(rf.replicateCh, server)
+			rf.mu.Unlock()
+			return
+		}
+		// 最近有回复说明流水线是通的; 否则之前发出的RPC可能都丢了(比如follower断开了),
+		// 不能让它们一直占着MaxInflightRPCs的名额, 改为每个心跳间隔试探一次
+		healthy := time.Since(rf.lastAck[server]) < rf.opts.ElectionTimeoutMin
+		// ReadIndex()要求立即发一轮心跳来确认领导地位
+		heartbeatDue := time.Since(lastSend) >= rf.opts.HeartbeatInterval || lastSend.Before(rf.heartbeatAfter)
+		switch {
+		case rf.nextIndex[server] <= rf.lastIncludedIndex:
+			// follower需要的日志已经被压缩进快照了, 改为发送快照
+			if !rf.installing[server] {
+				rf.installing[server] = true
+				lastSend = time.Now()
+				rf.wg.Add(1)
+				go rf.sendSnapshotTo(server)
+			}
+		case rf.nextIndex[server] <= rf.getLastLogIndex() && (healthy && (rf.opts.MaxInflightRPCs == 0 || rf.inflight[server] < rf.opts.MaxInflightRPCs) || heartbeatDue):
+			// 有新日志, 并且流水线还有空位
+			rf.sendEntriesTo(server, rf.nextIndex[server]-1, false)
+			lastSend = time.Now()
+			rf.mu.Unlock()
+			// 可能还有没发完的日志
+			continue
+		case heartbeatDue:
+			prevLogIndex := rf.nextIndex[server] - 1
+			// 还有携带日志的RPC在路上时, 心跳不要跑到它们前面去, 否则follower会因为日志对不上而拒绝
+			if healthy && rf.inflight[server] > 0 && rf.matchIndex[server] >= rf.lastIncludedIndex {
+				prevLogIndex = rf.matchIndex[server]
+			}
+			rf.sendEntriesTo(server, prevLogIndex, true)
+			lastSend = time.Now()
+		}
+		wait := rf.opts.HeartbeatInterval - time.Since(lastSend)
+		rf.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-rf.killCh:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 给server发送prevLogIndex之后的日志(心跳不带日志), 在新的goroutine里等待回复
+// 调用时需要持有rf.mu
+func (rf *Raft) sendEntriesTo(server int, prevLogIndex int, heartbeat bool) {
+	// 找到prevLog的任期号, 还没给follower发过日志，则没有prevLog，任期号也就是0
+	prevLogTerm := rf.getLogTerm(prevLogIndex)
+	entries := []Entry{}
+	if !heartbeat {
+		// 从prevLogIndex之后开始发送(受MaxEntriesPerRPC/MaxBytesPerRPC限制)
+		entries = rf.entriesFrom(prevLogIndex + 1)
+		// 乐观地认为这批日志会被接受, 下一批接着往后发
+		rf.nextIndex[server] = prevLogIndex + len(entries) + 1
+		rf.inflight[server]++
+	}
+	// 发送参数
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderId:     rf.me,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      entries,
+		LeaderCommit: rf.commitIndex,
+	}
+	// 只有replicator会调用, 它自己在rf.wg里
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		// 接收反馈信息的结构体
+		reply := AppendEntriesReply{}
+		// 发送
+		sent := time.Now()
+		ok := rf.sendAppendEntries(server, &args, &reply)
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		if !heartbeat {
+			rf.inflight[server]--
+		}
+		// 如果ok==false, 代表心跳包没发送出去, 有两种可能: 1. 该Leader失去连接 2. 接受心跳包的Follower失去连接
+		// 如果是可能性1, 那么发送出去的所有心跳包会不成功, 但replicator会一直发送。 当再次连接上的时候, 由于任期肯定小于其他服务器, 因此会退出, 变为Follower
+		// 如果是可能性2, 不影响, 继续发送心跳包给其他连接上的服务器
+		if !ok {
+			DPrintf("Leader %d: sending AppendEntries to server %d failed\n", rf.me, server)
+			// 这批日志没有送到, 之后的流水线也就接不上了, 从这里重新发
+			if !heartbeat && rf.currentTerm == args.Term && rf.state == Leader {
+				rf.rewindNextIndex(server, args.PrevLogIndex+1)
+			}
+			return
+		}
+		rf.handleAppendEntriesReply(server, &args, &reply, sent)
+	}()
+}
+
+// 处理AppendEntries的回复, 调用时需要持有rf.mu
+// 流水线下回复可能是乱序到达的, 所以matchIndex只增不减, nextIndex不能退到matchIndex之前
+func (rf *Raft) handleAppendEntriesReply(server int, args *AppendEntriesArgs, reply *AppendEntriesReply, sent time.Time) {
+	// 知道自己不是最新的leader了
+	if reply.Term > rf.currentTerm {
+		// 转换为follower, replicator随之退出
+		DPrintf("Leader %d: turn back to follower due to existing higher term %d from server %d\n", rf.me, reply.Term, server)
+		rf.convertToFollower(reply.Term, -1)
+		return
+	}
+	// 进行这一步判断很有必要, 比如两个goroutine先后收到回复, 第一个goroutine得到的reply.Term > rf.currentTerm从而转换为Follower并更新了currentTerm
+	// 如果不进行这个判断, 那么第二个goroutine在进行reply.Term > rf.currentTerm判断时会有reply.Term == rf.currentTerm，导致错误地进行后续流程
+	if rf.currentTerm != args.Term || rf.state != Leader {
+		return
+	}
+	// 不管日志是否匹配, 回复了同一任期就说明follower还认可这个leader
+	rf.recordAck(server, sent)
+	// 成功同步了follower
+	if reply.Success == true {
+		// 根据students-guide-to-raft中分析, 不能直接用leader当前的日志长度更新nextIndex
+		// (This is not safe because those values could have been updated since when you sent the RPC)
+		// follower中和leader的log可以匹配的日志的最高索引
+		if match := args.PrevLogIndex + len(args.Entries); match > rf.matchIndex[server] {
+			rf.matchIndex[server] = match
+		}
+		// 那下一个要发给follower的日志的起始位置至少是matchIndex + 1
+		if rf.nextIndex[server] <= rf.matchIndex[server] {
+			rf.nextIndex[server] = rf.matchIndex[server] + 1
+		}
+		// 领导权转移的目标追上了
+		rf.maybeSendTimeoutNow(server)
+		// paper中Figure 8的情形, 这个实现很妙!
+		// 按matchIndex排序, 找出超半数的server已经复制的日志项N (见quorumMatchIndex)
+		// matchIndex:leader记录的各个server已提交的最大日志索引, leader自己的就是最后一条日志
+		// 联合共识期间取C_old和C_new两者中较小的那个
+		N := rf.config.quorumIndex(func(s int) int {
+			if s == rf.me {
+				return rf.getLastLogIndex()
+			}
+			return rf.matchIndex[s]
+		})
+		// N大于leader已经提交的最大日志项索引
+		// 并且索引为N的日志项和leader的任期号是一致的
+		// leader更新自己要提交的日志索引值
+		if N > rf.commitIndex && rf.getLogTerm(N) == rf.currentTerm {
+			rf.commitIndex = N
+			// 配置提交后可能需要进入下一阶段
+			rf.advanceConfig()
+		}
+		DPrintf("Leader %d: start applying logs, lastApplied: %d, commitIndex: %d\n", rf.me, rf.lastApplied, rf.commitIndex)
+		// leader执行提交日志项，直到索引为commitIndex的日志
+		rf.startApplyLogs()
+		// 流水线空出了位置
+		rf.triggerReplicator(server)
+		return
+	}
+	// 没有成功同步follower
+	// 优化逻辑
+	next := reply.ConflictIndex
+	hasTermEuqalConflictTerm := false
+	for i := 0; i < len(rf.log); i++ {
+		if rf.log[i].Term == reply.ConflictTerm {
+			// 在leader中有日志项和follower的prev位置的日志项任期号是相同的
+			hasTermEuqalConflictTerm = true
+		}
+		// 该日志项的任期号大于follower的prev位置的日志项任期号
+		// 说明该日志项是follower还没有的，
+		// 因为follower的prev位置的日志项任期号已经是follower最大的任期号了
+		if rf.log[i].Term > reply.ConflictTerm {
+			// 在该log之前的日志项中有和follower的prev位置的日志项任期号是相同的
+			if hasTermEuqalConflictTerm {
+				// 下一个要发送给follower的就是leader的该条日志
+				// 示例：
+				// fol.logs =    1 1 1 2 2(prev)
+				// leader.logs = 1 1 1 2 3(prev) 3 3 ...
+				// 要发的entries          3       3 3 ...
+				next = rf.lastIncludedIndex + i
+			} else { // 对应的是follower prevIndex位置还没日志的情况,ConflictTerm为-1
+				// 下一个要发送给follower的是follower的len(log)位置的日志项
+				// 示例
+				// fol.logs =      x x
+				// leader.logs =   x x x prev x n x
+				// args.entries =             x n x
+				// 要发的entries为：     x prev x n x
+				next = reply.ConflictIndex
+			}
+			break
+		}
+		// 不存在follower有日志项任期号比leader还大的情况
+	}
+	rf.rewindNextIndex(server, next)
+	rf.triggerReplicator(server)
+}
+
+// 把server的nextIndex退回到index, 重新发送之后的日志, 调用时需要持有rf.mu
+// nextIndex不能退到matchIndex之前, 也不能小于1; 小于等于lastIncludedIndex时replicator会改为发送快照
+func (rf *Raft) rewindNextIndex(server int, index int) {
+	if index > rf.nextIndex[server] {
+		return
+	}
+	if index <= rf.matchIndex[server] {
+		index = rf.matchIndex[server] + 1
+	}
+	if index < 1 {
+		index = 1
+	}
+	rf.nextIndex[server] = index
+}
+
+// leader把自己的快照发送给落后太多的follower
+func (rf *Raft) sendSnapshotTo(server int) {
+	defer rf.wg.Done()
+	rf.mu.Lock()
+	if rf.state != Leader {
+		rf.installing[server] = false
+		rf.mu.Unlock()
+		return
+	}
+	args := InstallSnapshotArgs{
+		Term:              rf.currentTerm,
+		LeaderId:          rf.me,
+		LastIncludedIndex: rf.lastIncludedIndex,
+		LastIncludedTerm:  rf.lastIncludedTerm,
+		Config:            rf.snapshotConfig,
+		Data:              rf.readSnapshot(),
+	}
+	reply := InstallSnapshotReply{}
+	rf.mu.Unlock()
+	sent := time.Now()
+	DPrintf("Leader %d: send snapshot to server %d, lastIncludedIndex: %d\n", rf.me, server, args.LastIncludedIndex)
+	ok := rf.sendInstallSnapshot(server, &args, &reply)
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.installing[server] = false
+	if !ok {
+		DPrintf("Leader %d: sending InstallSnapshot to server %d failed\n", rf.me, server)
+		return
+	}
+	if reply.Term > rf.currentTerm {
+		rf.convertToFollower(reply.Term, -1)
+		return
+	}
+	if rf.currentTerm != args.Term || rf.state != Leader {
+		return
+	}
+	rf.recordAck(server, sent)
+	// follower已经有了快照里的全部日志
+	if args.LastIncludedIndex > rf.matchIndex[server] {
+		rf.matchIndex[server] = args.LastIncludedIndex
+	}
+	if rf.nextIndex[server] <= rf.matchIndex[server] {
+		rf.nextIndex[server] = rf.matchIndex[server] + 1
+	}
+	rf.triggerReplicator(server)
+}
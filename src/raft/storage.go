@@ -0,0 +1,211 @@
+package raft
+
+//
+// Raft通过Storage保存持久化状态, 不关心它存在哪里.
+//
+// Storage按raft状态的组成分开保存: currentTerm和votedFor、日志、快照.
+// persist()只把变化的部分交给Storage, 所以追加日志的开销和日志总长度无关
+// (前提是Storage本身支持增量写, 比如WALPersister).
+// 只能保存整块数据的Persister和FilePersister通过MakePersisterStorage()适配,
+// 每次写入都重新编码整个状态, 格式见format.go.
+// Make()仍然接受*Persister, 其他Storage通过MakeWithOptions()/MakeWithTransport()传入.
+//
+// Storage的写方法出错时Raft直接panic: 写到一半的状态不能再用来投票或者回复leader,
+// 和进程崩溃一样, 重启后从Storage里已经保存的状态恢复.
+//
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrCompacted   = errors.New("raft: requested entries have been compacted into the snapshot")
+	ErrUnavailable = errors.New("raft: requested entries are past the end of the log")
+)
+
+// the persistent state that isn't part of the log.
+type HardState struct {
+	Term     int
+	VotedFor int
+}
+
+// describes the log prefix that a snapshot replaced.
+type SnapshotMeta struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Config            Configuration
+}
+
+//
+// where Raft keeps its persistent state. the log starts right after
+// the snapshot, at index LastIncludedIndex+1. a Storage must not keep
+// references to the slices passed to it. Raft doesn't use a Storage
+// concurrently, but a Storage may be read by others (e.g. the tester)
+// while Raft writes to it. once a write has failed, Raft stops using
+// the Storage.
+//
+type Storage interface {
+	// the state saved so far. VotedFor is -1, and the log and
+	// snapshot empty, if nothing has been saved yet.
+	InitialState() (HardState, SnapshotMeta, error)
+	SetHardState(st HardState) error
+	// replace the entries from index on with entries; index may be
+	// at most LastIndex()+1. empty entries just truncate the log.
+	StoreEntries(index int, entries []Entry) error
+	// the entries with indexes in [lo, hi).
+	Entries(lo int, hi int) ([]Entry, error)
+	LastIndex() (int, error)
+	// atomically replace the snapshot, and the whole log with
+	// entries, which follow meta.LastIncludedIndex.
+	SaveSnapshot(meta SnapshotMeta, snapshot []byte, entries []Entry) error
+	Snapshot() ([]byte, error)
+}
+
+// a Storage on top of a StateStore.
+type persisterStorage struct {
+	mu     sync.Mutex
+	ps     StateStore
+	loaded bool
+	state  persistentState // ps里的内容解码之后的缓存
+}
+
+//
+// make a Storage that keeps Raft's state in ps, in the format Raft
+// used before Storage existed, so a Persister or FilePersister saved
+// by an older version can still be read. state saved in an older
+// format is rewritten in the current one by InitialState(). every
+// write re-encodes the whole state.
+//
+func MakePersisterStorage(ps StateStore) Storage {
+	return &persisterStorage{ps: ps}
+}
+
+// 第一次使用时解码ps里的状态, 调用时需要持有s.mu
+func (s *persisterStorage) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.state = persistentState{VotedFor: -1, Log: []Entry{}}
+	if data := s.ps.ReadRaftState(); len(data) > 0 {
+		ps, legacy, err := decodePersistentState(data)
+		if err != nil {
+			return err
+		}
+		if ps.Log == nil {
+			ps.Log = []Entry{}
+		}
+		s.state = ps
+		// 旧格式的状态马上按新格式重新保存
+		if legacy {
+			DPrintf("Storage: migrate persisted state to format version %d\n", stateVersion)
+			s.save()
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// 调用时需要持有s.mu
+func (s *persisterStorage) save() {
+	s.ps.SaveRaftState(encodePersistentState(s.state))
+}
+
+func (s *persisterStorage) InitialState() (HardState, SnapshotMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return HardState{}, SnapshotMeta{}, err
+	}
+	st := HardState{Term: s.state.Term, VotedFor: s.state.VotedFor}
+	meta := SnapshotMeta{
+		LastIncludedIndex: s.state.LastIncludedIndex,
+		LastIncludedTerm:  s.state.LastIncludedTerm,
+		Config:            s.state.SnapshotConfig,
+	}
+	return st, meta, nil
+}
+
+func (s *persisterStorage) SetHardState(st HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.state.Term = st.Term
+	s.state.VotedFor = st.VotedFor
+	s.save()
+	return nil
+}
+
+func (s *persisterStorage) StoreEntries(index int, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	k := index - 1 - s.state.LastIncludedIndex
+	if k < 0 {
+		return ErrCompacted
+	}
+	if k > len(s.state.Log) {
+		return ErrUnavailable
+	}
+	// 复制一份, 不和调用者共用底层数组
+	log := make([]Entry, k+len(entries))
+	copy(log, s.state.Log[:k])
+	copy(log[k:], entries)
+	s.state.Log = log
+	s.save()
+	return nil
+}
+
+func (s *persisterStorage) Entries(lo int, hi int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return sliceEntries(s.state.Log, s.state.LastIncludedIndex, lo, hi)
+}
+
+// log从first+1开始, 取出索引在[lo, hi)之间的日志
+func sliceEntries(log []Entry, first int, lo int, hi int) ([]Entry, error) {
+	if lo <= first {
+		return nil, ErrCompacted
+	}
+	if hi > first+len(log)+1 {
+		return nil, ErrUnavailable
+	}
+	if lo >= hi {
+		return []Entry{}, nil
+	}
+	return append([]Entry{}, log[lo-first-1:hi-first-1]...), nil
+}
+
+func (s *persisterStorage) LastIndex() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	return s.state.LastIncludedIndex + len(s.state.Log), nil
+}
+
+func (s *persisterStorage) SaveSnapshot(meta SnapshotMeta, snapshot []byte, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.state.LastIncludedIndex = meta.LastIncludedIndex
+	s.state.LastIncludedTerm = meta.LastIncludedTerm
+	s.state.SnapshotConfig = meta.Config
+	s.state.Log = append([]Entry{}, entries...)
+	s.ps.SaveStateAndSnapshot(encodePersistentState(s.state), snapshot)
+	return nil
+}
+
+func (s *persisterStorage) Snapshot() ([]byte, error) {
+	return s.ps.ReadSnapshot(), nil
+}
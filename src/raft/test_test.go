@@ -14,6 +14,16 @@ import "time"
 import "math/rand"
 import "sync/atomic"
 import "sync"
+import "sort"
+import "strings"
+import "context"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "bytes"
+import "encoding/gob"
+import "labrpc"
+import "strconv"
 
 // The tester generously allows solutions to complete elections in one second
 // (much more than the paper's range of timeouts).
@@ -111,8 +121,9 @@ func TestBasicAgree2B(t *testing.T) {
 	fmt.Printf("Test (2B): basic agreement ...\n")
 
 	// 测试逐步添加三个新日志
+	// 序号1是第一个leader当选时追加的NoOp，命令从序号2开始
 	iters := 3
-	for index := 1; index < iters+1; index++ {
+	for index := 2; index < iters+2; index++ {
 		// 有多少server认为序号为index的日志已经提交了
 		nd, _ := cfg.nCommitted(index)
 		// 事实上，序号为index的日志正打算添加，所以不应该有sever发现index已经提交了
@@ -214,9 +225,9 @@ func TestFailNoAgree2B(t *testing.T) {
 	if ok != true {
 		t.Fatalf("leader rejected Start()")
 	}
-	// 这是第二条指令
-	if index != 2 {
-		t.Fatalf("expected index 2, got %v", index)
+	// 这是第二条指令，在leader的NoOp之后，序号为3
+	if index != 3 {
+		t.Fatalf("expected index 3, got %v", index)
 	}
 	// 等待2次新的选举周期
 	time.Sleep(2 * RaftElectionTimeout)
@@ -233,7 +244,7 @@ func TestFailNoAgree2B(t *testing.T) {
 	cfg.connect((leader + 3) % servers)
 
 	// the disconnected majority may have chosen a leader from
-	// among their own ranks, forgetting index 2.
+	// among their own ranks, forgetting index 3.
 	// or perhaps
 	// 可能新的leader是从三台宕机又恢复的server中选出的
 	leader2 := cfg.checkOneLeader()
@@ -241,10 +252,10 @@ func TestFailNoAgree2B(t *testing.T) {
 	if ok2 == false {
 		t.Fatalf("leader2 rejected Start()")
 	}
-	// 因此index2可以为2，也可以为3
-	// 2代表新leader是从三台宕机又恢复的server中选出的，它们忽视了宕机时被执行的指令
-	// 3代表新leader依旧是旧有的两台server中选出的
-	if index2 < 2 || index2 > 3 {
+	// 新leader当选时会先追加一条NoOp，因此index2可以为4，也可以为5
+	// 4代表新leader是从三台宕机又恢复的server中选出的，它们忽视了宕机时被执行的指令
+	// 5代表新leader依旧是旧有的两台server中选出的
+	if index2 < 4 || index2 > 5 {
 		t.Fatalf("unexpected index %v", index2)
 	}
 
@@ -1104,3 +1115,1534 @@ func TestReliableChurn2C(t *testing.T) {
 func TestUnreliableChurn2C(t *testing.T) {
 	internalChurn(t, true)
 }
+
+//2D 日志压缩的测试逻辑：
+//1、断开一个follower，其余server提交若干日志后都做快照，日志被截断
+//2、重新连接follower，它需要的日志已经不在leader的log里，只能通过InstallSnapshot追上
+func TestSnapshotInstall2D(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2D): install snapshot on a lagging follower ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	cfg.disconnect(follower)
+
+	for i := 0; i < 30; i++ {
+		cfg.one(rand.Int(), servers-1)
+	}
+
+	before := cfg.saved[leader].RaftStateSize()
+	for i := 0; i < servers; i++ {
+		if i != follower {
+			cfg.snapshot(i)
+		}
+	}
+	if after := cfg.saved[leader].RaftStateSize(); after >= before {
+		t.Fatalf("raft state did not shrink after snapshot: %v -> %v", before, after)
+	}
+
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//重启后server要从持久化的快照和剩余的日志中恢复
+func TestSnapshotRestart2D(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2D): restart from snapshot ...\n")
+
+	for iters := 0; iters < 3; iters++ {
+		for i := 0; i < 10; i++ {
+			cfg.one(rand.Int(), servers)
+		}
+		for i := 0; i < servers; i++ {
+			cfg.snapshot(i)
+		}
+		cfg.one(rand.Int(), servers)
+
+		for i := 0; i < servers; i++ {
+			cfg.start1(i)
+		}
+		for i := 0; i < servers; i++ {
+			cfg.connect(i)
+		}
+		cfg.one(rand.Int(), servers)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//成员变更的测试逻辑：
+//1、5个server的集群移除两个server，新集群只有3个成员
+//2、断开被移除的两个server和新集群中的一个follower，剩下的2个server在新配置下仍是多数派，可以提交
+//3、把两个server重新加入集群，5个server都能提交
+//4、移除leader自己，它退位之后仍然记得这个任期投给了自己，剩下4个server照常提交
+func TestChangeConfig(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (membership): remove and re-add servers ...\n")
+
+	cfg.one(101, servers)
+
+	leader := cfg.checkOneLeader()
+	removed := []int{(leader + 1) % servers, (leader + 2) % servers}
+	kept := []int{leader, (leader + 3) % servers, (leader + 4) % servers}
+	sort.Ints(kept)
+	cfg.changeConfig(kept)
+	cfg.one(102, 3)
+
+	cfg.disconnect(removed[0])
+	cfg.disconnect(removed[1])
+	cfg.one(103, 3)
+
+	// 在旧配置下2个server不够多数派
+	follower := (leader + 3) % servers
+	cfg.disconnect(follower)
+	cfg.one(104, 2)
+	cfg.connect(follower)
+
+	// 被移除的server不会发起选举，重新连上后不会干扰集群
+	cfg.connect(removed[0])
+	cfg.connect(removed[1])
+	cfg.changeConfig([]int{0, 1, 2, 3, 4})
+	cfg.one(105, servers)
+
+	leader = cfg.checkOneLeader()
+	term1, _ := cfg.rafts[leader].GetState()
+	others := []int{}
+	for i := 0; i < servers; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	cfg.changeConfig(others)
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 2*RaftElectionTimeout {
+			t.Fatalf("removed leader %v didn't step down", leader)
+		}
+		rf := cfg.rafts[leader]
+		rf.mu.Lock()
+		state, term, votedFor := rf.state, rf.currentTerm, rf.votedFor
+		rf.mu.Unlock()
+		if state == Leader {
+			continue
+		}
+		if term == term1 && votedFor != leader {
+			t.Fatalf("removed leader %v forgot its vote in term %v; votedFor is %v", leader, term, votedFor)
+		}
+		break
+	}
+	cfg.one(106, servers-1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//领导权转移的测试逻辑：
+//1、leader把领导权交给一个follower，这个follower应该很快成为新的leader
+//2、目标server断开时转移会超时，原leader放弃转移并继续接受Start
+func TestTransferLeadership(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (transfer): leadership transfer ...\n")
+
+	cfg.one(101, servers)
+
+	leader1 := cfg.checkOneLeader()
+	target := (leader1 + 1) % servers
+	if ok := cfg.rafts[leader1].TransferLeadership(target); !ok {
+		t.Fatalf("leader %v failed to transfer leadership to %v", leader1, target)
+	}
+	if leader2 := cfg.checkOneLeader(); leader2 != target {
+		t.Fatalf("expected %v to be leader after transfer, got %v", target, leader2)
+	}
+	cfg.one(102, servers)
+
+	// 转移的目标断开了, 转移应该在一个选举超时内放弃
+	other := (target + 1) % servers
+	cfg.disconnect(other)
+	t0 := time.Now()
+	if ok := cfg.rafts[target].TransferLeadership(other); ok {
+		t.Fatalf("transfer to a disconnected server should fail")
+	}
+	if time.Since(t0) > RaftElectionTimeout {
+		t.Fatalf("aborting a transfer took too long: %v", time.Since(t0))
+	}
+	if _, _, ok := cfg.rafts[target].Start(103); !ok {
+		t.Fatalf("leader rejected Start() after aborting a transfer")
+	}
+	cfg.connect(other)
+	cfg.one(104, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//PreVote的测试逻辑：
+//1、断开一个follower，它会不断选举超时，但预投票得不到多数派同意，任期号不会增加
+//2、重新连接后它直接接受leader的心跳，leader和任期号都不变
+func TestPreVote(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.PreVote = true
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (prevote): rejoining follower doesn't disrupt the leader ...\n")
+
+	cfg.one(101, servers)
+
+	leader := cfg.checkOneLeader()
+	term1 := cfg.checkTerms()
+
+	follower := (leader + 1) % servers
+	cfg.disconnect(follower)
+	cfg.one(102, servers-1)
+	time.Sleep(2 * RaftElectionTimeout)
+	if term, _ := cfg.rafts[follower].GetState(); term != term1 {
+		t.Fatalf("partitioned follower's term changed from %v to %v", term1, term)
+	}
+
+	cfg.connect(follower)
+	cfg.one(103, servers)
+	if leader2 := cfg.checkOneLeader(); leader2 != leader {
+		t.Fatalf("leader changed from %v to %v after the follower rejoined", leader, leader2)
+	}
+	if term2 := cfg.checkTerms(); term2 != term1 {
+		t.Fatalf("term changed from %v to %v after the follower rejoined", term1, term2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//CheckQuorum的测试逻辑：
+//leader和两个follower断开连接后，在几个选举超时之内应该自己退位
+//不再通过GetState和HasQuorum声称自己是leader，而且仍然记得这个任期投给了自己
+//重新连上之后集群仍然能正常达成一致
+func TestCheckQuorum(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.CheckQuorum = true
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (checkquorum): isolated leader steps down ...\n")
+
+	cfg.one(101, servers)
+
+	leader := cfg.checkOneLeader()
+	if !cfg.rafts[leader].HasQuorum() {
+		t.Fatalf("connected leader %v reports no quorum", leader)
+	}
+
+	term1, _ := cfg.rafts[leader].GetState()
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+	// 退位之后马上检查: 下一次选举之前仍然是同一个任期, 而且记得这个任期投给了自己
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 2*RaftElectionTimeout {
+			t.Fatalf("isolated leader %v didn't step down", leader)
+		}
+		rf := cfg.rafts[leader]
+		rf.mu.Lock()
+		state, term, votedFor := rf.state, rf.currentTerm, rf.votedFor
+		rf.mu.Unlock()
+		if state == Leader {
+			continue
+		}
+		if term == term1 && votedFor != leader {
+			t.Fatalf("leader %v forgot its vote in term %v when stepping down; votedFor is %v", leader, term, votedFor)
+		}
+		break
+	}
+	time.Sleep(RaftElectionTimeout)
+	if _, isLeader := cfg.rafts[leader].GetState(); isLeader {
+		t.Fatalf("isolated leader %v is a leader again", leader)
+	}
+	if cfg.rafts[leader].HasQuorum() {
+		t.Fatalf("isolated server %v still reports a quorum", leader)
+	}
+
+	cfg.connect((leader + 1) % servers)
+	cfg.connect((leader + 2) % servers)
+	cfg.one(102, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//ReadIndex的测试逻辑：
+//1、leader可以通过ReadIndex读到已经提交的日志，follower的ReadIndex失败
+//2、每次ReadIndex都要等一轮新的心跳得到确认，follower收到的RPC随之增加
+//3、断开leader后，新leader当选时追加的NoOp提交之后，不需要新的Start也能ReadIndex
+//4、被隔离的旧leader无法得到多数派的确认，ReadIndex失败
+func TestReadIndex(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (readindex): linearizable reads ...\n")
+
+	index1 := cfg.one(101, servers)
+	leader1 := cfg.checkOneLeader()
+	if index, ok := cfg.rafts[leader1].ReadIndex(); !ok || index < index1 {
+		t.Fatalf("leader ReadIndex() = %v, %v; expected at least %v", index, ok, index1)
+	}
+	if _, ok := cfg.rafts[(leader1+1)%servers].ReadIndex(); ok {
+		t.Fatalf("follower ReadIndex() succeeded")
+	}
+
+	// 每次ReadIndex至少要有一个follower回复在它开始之后发出的RPC, 凑成多数派
+	followerRPCs := func() int {
+		n := 0
+		for i := 0; i < servers; i++ {
+			if i != leader1 {
+				n += cfg.rpcCount(i)
+			}
+		}
+		return n
+	}
+	reads := 10
+	before := followerRPCs()
+	for i := 0; i < reads; i++ {
+		if _, ok := cfg.rafts[leader1].ReadIndex(); !ok {
+			t.Fatalf("leader ReadIndex() failed")
+		}
+	}
+	if sent := followerRPCs() - before; sent < reads {
+		t.Fatalf("%v ReadIndex() calls confirmed with only %v RPCs to followers", reads, sent)
+	}
+
+	cfg.disconnect(leader1)
+	leader2 := cfg.checkOneLeader()
+	if index, ok := cfg.rafts[leader2].ReadIndex(); !ok || index <= index1 {
+		t.Fatalf("new leader ReadIndex() = %v, %v; expected past %v once its no-op committed", index, ok, index1)
+	}
+	index2 := cfg.one(102, servers-1)
+	if index, ok := cfg.rafts[leader2].ReadIndex(); !ok || index < index2 {
+		t.Fatalf("new leader ReadIndex() = %v, %v; expected at least %v", index, ok, index2)
+	}
+
+	// 旧leader还以为自己是leader, 但得不到多数派的确认
+	if _, ok := cfg.rafts[leader1].ReadIndex(); ok {
+		t.Fatalf("partitioned old leader ReadIndex() succeeded")
+	}
+
+	cfg.connect(leader1)
+	cfg.one(103, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//租约读的测试逻辑：
+//1、leader在租约内可以直接读，不需要额外的一轮心跳
+//2、断开leader，租约过期之后旧leader不能再用租约读，新leader提交日志后可以
+//3、租约期间follower只给领导权转移发起的选举投票，领导权转移仍然可以完成
+func TestLeaseRead(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.LeaseRead = true
+	opts.ClockDrift = 10 * time.Millisecond
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (leaseread): reads served under a leader lease ...\n")
+
+	index1 := cfg.one(101, servers)
+	leader1 := cfg.checkOneLeader()
+	if index, ok := cfg.rafts[leader1].LeaseRead(); !ok || index < index1 {
+		t.Fatalf("leader LeaseRead() = %v, %v; expected at least %v", index, ok, index1)
+	}
+	if _, ok := cfg.rafts[(leader1+1)%servers].LeaseRead(); ok {
+		t.Fatalf("follower LeaseRead() succeeded")
+	}
+
+	cfg.disconnect(leader1)
+	time.Sleep(RaftElectionTimeout / 2)
+	if _, ok := cfg.rafts[leader1].LeaseRead(); ok {
+		t.Fatalf("partitioned old leader LeaseRead() succeeded after its lease expired")
+	}
+	index2 := cfg.one(102, servers-1)
+	leader2 := cfg.checkOneLeader()
+	if index, ok := cfg.rafts[leader2].LeaseRead(); !ok || index < index2 {
+		t.Fatalf("new leader LeaseRead() = %v, %v; expected at least %v", index, ok, index2)
+	}
+
+	cfg.connect(leader1)
+	cfg.one(103, servers)
+	if !cfg.rafts[leader2].TransferLeadership(leader1) {
+		t.Fatalf("leadership transfer failed with lease reads enabled")
+	}
+	if leader3 := cfg.checkOneLeader(); leader3 != leader1 {
+		t.Fatalf("expected leader %v after the transfer, got %v", leader1, leader3)
+	}
+	cfg.one(104, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//NoOp的测试逻辑：
+//1、断开两个follower后，leader1追加的日志102只在自己的日志里
+//2、断开leader1，连回f1，f1自己选不出leader，任期号不断增加
+//3、连回leader1，f1的任期更高，leader1退位，但只有leader1的日志足够新，它会在更高的任期重新当选
+//   如果没有NoOp，102不是当前任期的日志，在没有新的Start之前一直无法提交
+func TestNoOp(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (noop): new leader commits entries from earlier terms ...\n")
+
+	cfg.one(101, servers)
+
+	leader1 := cfg.checkOneLeader()
+	f1 := (leader1 + 1) % servers
+	f2 := (leader1 + 2) % servers
+	cfg.disconnect(f1)
+	cfg.disconnect(f2)
+	index, term1, ok := cfg.rafts[leader1].Start(102)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+
+	cfg.disconnect(leader1)
+	cfg.connect(f1)
+	time.Sleep(RaftElectionTimeout)
+	cfg.connect(leader1)
+	if leader2 := cfg.checkOneLeader(); leader2 != leader1 {
+		t.Fatalf("expected %v to be re-elected, got %v", leader1, leader2)
+	}
+	if term2, _ := cfg.rafts[leader1].GetState(); term2 == term1 {
+		t.Fatalf("leader wasn't re-elected in a new term")
+	}
+	t0 := time.Now()
+	for {
+		if nd, cmd := cfg.nCommitted(index); nd >= 2 {
+			if cmd != 102 {
+				t.Fatalf("index %v committed %v, expected 102", index, cmd)
+			}
+			break
+		}
+		if time.Since(t0) > 2*RaftElectionTimeout {
+			t.Fatalf("entry from an earlier term wasn't committed by the new leader")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cfg.connect(f2)
+	cfg.one(103, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Kill的测试逻辑：
+//1、正常选举、提交日志，期间crash并重启一个server
+//2、Kill之后Start不再成功，Kill返回时Raft启动的goroutine(包括还在发RPC的)都已经退出
+//3、Transport不理会context、回复要过一会才到时，Kill也要等这些RPC返回之后才返回
+func TestKill(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+
+	fmt.Printf("Test (kill): Kill() stops all goroutines ...\n")
+
+	cfg.one(101, servers)
+	leader := cfg.checkOneLeader()
+	cfg.crash1((leader + 1) % servers)
+	cfg.one(102, servers-1)
+	cfg.start1((leader + 1) % servers)
+	cfg.connect((leader + 1) % servers)
+	cfg.one(103, servers)
+
+	leader = cfg.checkOneLeader()
+	rf := cfg.rafts[leader]
+	rf.Kill()
+	if _, _, ok := rf.Start(104); ok {
+		t.Fatalf("killed leader accepted Start()")
+	}
+
+	cfg.cleanup()
+	if left := raftGoroutines(); len(left) > 0 {
+		t.Fatalf("%v goroutines still running after Kill():\n%v", len(left), strings.Join(left, "\n\n"))
+	}
+
+	dn := make_direct_net(t, servers)
+	dn.one(201, []int{0, 1, 2})
+	dn.slowReplies(100 * time.Millisecond)
+	// 等心跳发出去, 让每个server都有还没收到回复的RPC
+	time.Sleep(RaftElectionTimeout / 4)
+	dn.cleanup()
+	if left := raftGoroutines(); len(left) > 0 {
+		t.Fatalf("%v goroutines still running after Kill() with slow replies:\n%v", len(left), strings.Join(left, "\n\n"))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Options的测试逻辑：
+//检查明显不合理的参数会被Validate和MakeWithOptions拒绝
+func TestOptionsValidate(t *testing.T) {
+	fmt.Printf("Test (config): invalid settings are rejected ...\n")
+
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Fatalf("DefaultOptions() is invalid: %v", err)
+	}
+	bad := []func(c *Options){
+		func(c *Options) { c.ElectionTimeoutMax = c.ElectionTimeoutMin },
+		func(c *Options) { c.ElectionTimeoutMin = 0 },
+		func(c *Options) {
+			c.ElectionTimeoutMin = 10 * time.Millisecond
+			c.ElectionTimeoutMax = 10*time.Millisecond + 500*time.Microsecond
+			c.HeartbeatInterval = 5 * time.Millisecond
+		},
+		func(c *Options) { c.HeartbeatInterval = 0 },
+		func(c *Options) { c.HeartbeatInterval = c.ElectionTimeoutMin },
+		func(c *Options) { c.MaxEntriesPerRPC = -1 },
+		func(c *Options) { c.MaxInflightRPCs = -1 },
+		func(c *Options) { c.LeaseRead = true; c.ClockDrift = c.ElectionTimeoutMin },
+	}
+	for i, f := range bad {
+		c := DefaultOptions()
+		f(&c)
+		if c.Validate() == nil {
+			t.Fatalf("invalid options %v (%+v) accepted", i, c)
+		}
+		if rf, err := MakeWithOptions(nil, 0, MakePersisterStorage(MakePersister()), make(chan ApplyMsg), c); err == nil || rf != nil {
+			t.Fatalf("MakeWithOptions() accepted invalid options %v", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//AppendEntries限制的测试逻辑：
+//每个RPC最多携带两条日志、每个follower最多一个进行中的RPC
+//一个follower断开期间提交多条日志，重新连上后仍然能追上
+func TestRPCLimits(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.ElectionTimeoutMin = 150 * time.Millisecond
+	opts.ElectionTimeoutMax = 300 * time.Millisecond
+	opts.HeartbeatInterval = 50 * time.Millisecond
+	opts.MaxEntriesPerRPC = 2
+	opts.MaxBytesPerRPC = 64
+	opts.MaxInflightRPCs = 1
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (config): limits on AppendEntries ...\n")
+
+	cfg.one(101, servers)
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+	for i := 0; i < 20; i++ {
+		cfg.one(rand.Int(), servers-1)
+	}
+	cfg.connect((leader + 1) % servers)
+	cfg.one(102, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//复制性能的测试逻辑(和labrpc的TestBenchmark一样只打印结果，不做断言)：
+//1、吞吐量：leader连续Start很多条命令，等全部server都提交
+//2、延迟：每次Start一条命令，等leader提交(可以回复客户端)之后再Start下一条
+func TestBenchmarkReplication(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (replication): benchmark ...\n")
+
+	cfg.one(100, servers)
+	leader := cfg.checkOneLeader()
+
+	// 等待index被expected个server提交
+	waitCommitted := func(index int, expected int) {
+		t0 := time.Now()
+		for {
+			if nd, _ := cfg.nCommitted(index); nd >= expected {
+				return
+			}
+			if time.Since(t0) > 10*time.Second {
+				t.Fatalf("index %v not committed by all servers", index)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	n := 1000
+	t0 := time.Now()
+	last := 0
+	for i := 0; i < n; i++ {
+		index, _, ok := cfg.rafts[leader].Start(1000 + i)
+		if !ok {
+			t.Fatalf("leader lost leadership during the benchmark")
+		}
+		last = index
+	}
+	waitCommitted(last, servers)
+	elapsed := time.Since(t0)
+	fmt.Printf("  throughput: %v for %v commands, %.0f commands/second\n", elapsed, n, float64(n)/elapsed.Seconds())
+
+	n = 50
+	t0 = time.Now()
+	for i := 0; i < n; i++ {
+		index, _, ok := cfg.rafts[leader].Start(2000 + i)
+		if !ok {
+			t.Fatalf("leader lost leadership during the benchmark")
+		}
+		waitCommitted(index, 1)
+	}
+	fmt.Printf("  latency: %v per command\n", time.Since(t0)/time.Duration(n))
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Propose的测试逻辑：
+//1、leader上Propose的命令提交后Future返回它的索引，follower上返回ErrNotLeader
+//2、断开leader，它的Propose一直无法提交，Wait在context超时后返回，leader不再记录这个Future
+//   重新连上后旧leader的日志被新leader覆盖，没有超时的Future返回ErrTermChanged，超时的仍然返回超时
+//3、Kill之后还没有结果的Future返回ErrShutdown
+func TestPropose(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (propose): futures report the outcome of a command ...\n")
+
+	index1 := cfg.one(101, servers)
+	leader1 := cfg.checkOneLeader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	f := cfg.rafts[leader1].Propose(ctx, 102)
+	if index, err := f.Wait(); err != nil || index != index1+1 {
+		t.Fatalf("Propose(102) = %v, %v; expected %v, nil", index, err, index1+1)
+	}
+	// Future返回时102已经交给了applyCh, tester稍后就能看到它
+	if nd, cmd := cfg.nCommitted(index1 + 1); nd == 0 || cmd != 102 {
+		time.Sleep(50 * time.Millisecond)
+		if nd, cmd = cfg.nCommitted(index1 + 1); nd == 0 || cmd != 102 {
+			t.Fatalf("Future resolved but 102 was not applied")
+		}
+	}
+	f = cfg.rafts[(leader1+1)%servers].Propose(ctx, 103)
+	if _, err := f.Wait(); err != ErrNotLeader {
+		t.Fatalf("follower Propose() returned %v; expected ErrNotLeader", err)
+	}
+
+	cfg.disconnect(leader1)
+	short, cancelShort := context.WithTimeout(context.Background(), RaftElectionTimeout)
+	defer cancelShort()
+	timedOut := cfg.rafts[leader1].Propose(short, 104)
+	f = cfg.rafts[leader1].Propose(ctx, 105)
+	if _, err := timedOut.Wait(); err != context.DeadlineExceeded {
+		t.Fatalf("partitioned leader Propose() returned %v; expected a context timeout", err)
+	}
+	// 超时的Future已经有了结果, leader只还记着另一个
+	select {
+	case <-timedOut.Done():
+	default:
+		t.Fatalf("Future not done after its context timed out")
+	}
+	cfg.rafts[leader1].mu.Lock()
+	pending := len(cfg.rafts[leader1].proposals)
+	cfg.rafts[leader1].mu.Unlock()
+	if pending != 1 {
+		t.Fatalf("partitioned leader tracks %v proposals; expected 1", pending)
+	}
+	cfg.one(106, servers-1)
+	cfg.connect(leader1)
+	select {
+	case <-f.Done():
+	case <-time.After(2 * RaftElectionTimeout):
+		t.Fatalf("overwritten proposal never resolved")
+	}
+	if _, err := f.Wait(); err != ErrTermChanged {
+		t.Fatalf("overwritten proposal returned %v; expected ErrTermChanged", err)
+	}
+	if _, err := timedOut.Wait(); err != context.DeadlineExceeded {
+		t.Fatalf("timed-out proposal returned %v after the leader changed; expected a context timeout", err)
+	}
+
+	leader2 := cfg.checkOneLeader()
+	cfg.disconnect((leader2 + 1) % servers)
+	cfg.disconnect((leader2 + 2) % servers)
+	f = cfg.rafts[leader2].Propose(ctx, 107)
+	cfg.rafts[leader2].Kill()
+	if _, err := f.Wait(); err != ErrShutdown {
+		t.Fatalf("Propose() on a killed leader returned %v; expected ErrShutdown", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//转发proposal的测试逻辑：
+//1、所有server都知道谁是leader，follower的Start转发给leader，返回leader给出的索引和任期号
+//2、断开leader，选出新leader之前follower的转发失败；新leader选出后转发给新leader
+//3、旧leader重新连上之后也知道了新leader
+func TestForwardProposal(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.ForwardProposals = true
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (forward): followers forward Start() to the leader ...\n")
+
+	index1 := cfg.one(101, servers)
+	leader1 := cfg.checkOneLeader()
+	for i := 0; i < servers; i++ {
+		if leader, _ := cfg.rafts[i].GetLeader(); leader != leader1 {
+			t.Fatalf("server %v thinks the leader is %v; expected %v", i, leader, leader1)
+		}
+	}
+
+	follower := (leader1 + 1) % servers
+	index, term, ok := cfg.rafts[follower].Start(102)
+	if !ok || index != index1+1 {
+		t.Fatalf("forwarded Start() = %v, %v, %v; expected index %v", index, term, ok, index1+1)
+	}
+	if leaderTerm, _ := cfg.rafts[leader1].GetState(); term != leaderTerm {
+		t.Fatalf("forwarded Start() returned term %v; leader is in term %v", term, leaderTerm)
+	}
+	cfg.wait(index, servers, term)
+
+	cfg.disconnect(leader1)
+	if _, _, ok := cfg.rafts[follower].Start(103); ok {
+		// 新leader可能已经选出来了，这时转发给它也是对的
+		if leader, _ := cfg.rafts[follower].GetLeader(); leader == leader1 {
+			t.Fatalf("Start() forwarded to a disconnected leader succeeded")
+		}
+	}
+
+	leader2 := cfg.checkOneLeader()
+	follower = (leader2 + 1) % servers
+	if follower == leader1 {
+		follower = (leader2 + 2) % servers
+	}
+	// follower可能还没收到新leader的心跳
+	time.Sleep(RaftElectionTimeout / 2)
+	index, term, ok = cfg.rafts[follower].Start(104)
+	if !ok {
+		t.Fatalf("Start() on a follower of the new leader failed")
+	}
+	cfg.wait(index, servers-1, term)
+
+	cfg.connect(leader1)
+	cfg.one(105, servers)
+	if leader, _ := cfg.rafts[leader1].GetLeader(); leader != leader2 {
+		t.Fatalf("old leader thinks the leader is %v; expected %v", leader, leader2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//learner的测试逻辑：
+//1、4个server，其中一个是初始的learner，它也能收到并apply所有日志，但从不发起选举
+//2、learner不计入多数派：只剩leader和learner连通时不能提交
+//3、运行时把一个被移除的server作为learner加回来，它能追上日志
+//4、把learner提升为voter，之后它计入多数派
+func TestLearner(t *testing.T) {
+	servers := 4
+	learner := servers - 1
+	opts := DefaultOptions()
+	opts.InitialLearners = []int{learner}
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (learner): non-voting learners ...\n")
+
+	cfg.one(101, servers)
+
+	// 断开的learner不会选举超时变成candidate
+	term1, _ := cfg.rafts[learner].GetState()
+	cfg.disconnect(learner)
+	time.Sleep(2 * RaftElectionTimeout)
+	if term, isLeader := cfg.rafts[learner].GetState(); term != term1 || isLeader {
+		t.Fatalf("disconnected learner started an election: term %v -> %v", term1, term)
+	}
+	cfg.connect(learner)
+	cfg.one(102, servers)
+
+	// leader和learner不构成多数派
+	leader := cfg.checkOneLeader()
+	voter1 := (leader + 1) % learner
+	voter2 := (leader + 2) % learner
+	cfg.disconnect(voter1)
+	cfg.disconnect(voter2)
+	index, _, ok := cfg.rafts[leader].Start(103)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+	time.Sleep(RaftElectionTimeout)
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		t.Fatalf("%v committed with only the leader and a learner", n)
+	}
+	cfg.connect(voter1)
+	cfg.connect(voter2)
+	cfg.one(104, servers)
+
+	// 移除一个voter，再把它作为learner加回来
+	leader = cfg.checkOneLeader()
+	removed := (leader + 1) % learner
+	voters := []int{}
+	for i := 0; i < learner; i++ {
+		if i != removed {
+			voters = append(voters, i)
+		}
+	}
+	cfg.changeConfig(voters)
+	cfg.disconnect(removed)
+	cfg.one(105, servers-1)
+	cfg.connect(removed)
+	cfg.addLearner(removed)
+	cfg.one(106, servers)
+
+	// learner提升为voter之后，没有它就凑不齐多数派了
+	cfg.promoteLearner(learner)
+	leader = cfg.checkOneLeader()
+	other := voters[0]
+	if other == leader {
+		other = voters[1]
+	}
+	cfg.disconnect(learner)
+	cfg.disconnect(removed)
+	cfg.disconnect(other)
+	index, _, ok = cfg.rafts[leader].Start(107)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+	time.Sleep(RaftElectionTimeout)
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		t.Fatalf("%v committed without a majority of the new voters", n)
+	}
+	cfg.connect(learner)
+	cfg.one(108, servers-2)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//FilePersister的测试逻辑：
+//1、保存的状态和快照重新打开目录后还在，crash留下的临时文件和没有被引用的快照会被清理
+//2、所有raft节点都把状态写到磁盘上，全部crash之后重新打开目录启动，之前提交的日志都还在
+func TestFilePersister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("Test (persist): state survives reopening a FilePersister ...\n")
+
+	fp, err := MakeFilePersister(filepath.Join(dir, "fp"))
+	if err != nil {
+		t.Fatalf("MakeFilePersister(): %v", err)
+	}
+	fp.SaveStateAndSnapshot([]byte("state1"), []byte("snapshot1"))
+	fp.SaveRaftState([]byte("state2"))
+	// 模拟在写第二个快照的过程中crash: 留下写了一半的临时文件和还没被引用的快照
+	ioutil.WriteFile(filepath.Join(dir, "fp", "raftstate.tmp"), []byte("torn"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "fp", "snapshot-2"), []byte("snapshot2"), 0644)
+
+	fp, err = MakeFilePersister(filepath.Join(dir, "fp"))
+	if err != nil {
+		t.Fatalf("reopening FilePersister: %v", err)
+	}
+	if state := fp.ReadRaftState(); !bytes.Equal(state, []byte("state2")) {
+		t.Fatalf("reopened state is %q; expected %q", state, "state2")
+	}
+	if snapshot := fp.ReadSnapshot(); !bytes.Equal(snapshot, []byte("snapshot1")) {
+		t.Fatalf("reopened snapshot is %q; expected %q", snapshot, "snapshot1")
+	}
+	names, _ := ioutil.ReadDir(filepath.Join(dir, "fp"))
+	if len(names) != 2 {
+		t.Fatalf("expected only the state file and one snapshot after reopening, found %v files", len(names))
+	}
+
+	servers := 3
+	cfg := make_config_on_disk(t, servers, false, DefaultOptions(), filepath.Join(dir, "cluster"), openFilePersister)
+	defer cfg.cleanup()
+
+	indexes := map[int]int{}
+	indexes[101] = cfg.one(101, servers)
+	indexes[102] = cfg.one(102, servers)
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	indexes[103] = cfg.one(103, servers)
+	for cmd, index := range indexes {
+		if n, v := cfg.nCommitted(index); n != servers || v != cmd {
+			t.Fatalf("entry %v is %v on %v servers after the restart; expected %v on all", index, v, n, cmd)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//WALPersister的测试逻辑：
+//1、追加一条日志时WAL只增长这一条记录的大小，而不是重新写整个日志
+//2、覆盖冲突的日志、快照之后重新打开目录，重放得到的状态和保存的一致，快照之前的segment被删掉
+//3、最后一条记录只写了一半(追加时crash)时，重新打开会丢掉这半条记录
+//4、所有raft节点都使用WAL，做快照、全部crash之后重新打开目录启动，之前提交的日志都还在
+func TestWALPersister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("Test (persist): write-ahead log ...\n")
+
+	walDir := filepath.Join(dir, "wal")
+	wp, err := MakeWALPersister(walDir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister(): %v", err)
+	}
+	store := func(index int, entries []Entry) {
+		if err := wp.StoreEntries(index, entries); err != nil {
+			t.Fatalf("StoreEntries(%v): %v", index, err)
+		}
+	}
+	log := []Entry{}
+	for i := 1; i <= 1000; i++ {
+		log = append(log, commandEntry(1, i))
+	}
+	wp.SetHardState(HardState{Term: 1, VotedFor: 0})
+	store(1, log)
+	before := wp.RaftStateSize()
+	log = append(log, commandEntry(1, 1001))
+	store(1001, log[1000:])
+	if grown := wp.RaftStateSize() - before; grown <= 0 || grown > before/10 {
+		t.Fatalf("appending one entry grew the WAL from %v by %v bytes", before, grown)
+	}
+
+	// 新leader覆盖了最后两条日志
+	log = append(log[:999:999], commandEntry(2, 2000), commandEntry(2, 2001))
+	wp.SetHardState(HardState{Term: 2, VotedFor: 1})
+	store(1000, log[999:])
+	if err := wp.StoreEntries(1003, []Entry{commandEntry(2, 2003)}); err != ErrUnavailable {
+		t.Fatalf("StoreEntries() past the end of the log returned %v; expected ErrUnavailable", err)
+	}
+	wp.Close()
+
+	// 重新打开WAL, 读出全部状态
+	replay := func(what string) (HardState, SnapshotMeta, []Entry) {
+		wp, err = MakeWALPersister(walDir)
+		if err != nil {
+			t.Fatalf("%v: reopening WAL: %v", what, err)
+		}
+		st, meta, _ := wp.InitialState()
+		last, _ := wp.LastIndex()
+		entries, err := wp.Entries(meta.LastIncludedIndex+1, last+1)
+		if err != nil {
+			t.Fatalf("%v: replaying entries: %v", what, err)
+		}
+		return st, meta, entries
+	}
+
+	check := func(what string, term int, lastIncludedIndex int, last int) {
+		st, meta, entries := replay(what)
+		n := len(entries)
+		if st.Term != term || meta.LastIncludedIndex != lastIncludedIndex || n == 0 || entryCommand(entries[n-1]) != last {
+			t.Fatalf("%v: replayed term %v, lastIncludedIndex %v, %v entries; expected term %v, lastIncludedIndex %v, last command %v",
+				what, st.Term, meta.LastIncludedIndex, n, term, lastIncludedIndex, last)
+		}
+		if meta.LastIncludedIndex+n != 1001 {
+			t.Fatalf("%v: replayed log ends at %v; expected 1001", what, meta.LastIncludedIndex+n)
+		}
+	}
+	check("overwritten entries", 2, 0, 2001)
+
+	// 快照之后只剩一个segment
+	if err := wp.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 500, LastIncludedTerm: 1}, []byte("snapshot"), log[500:]); err != nil {
+		t.Fatalf("SaveSnapshot(): %v", err)
+	}
+	wp.Close()
+	if segments, _ := filepath.Glob(filepath.Join(walDir, "wal-*")); len(segments) != 1 {
+		t.Fatalf("expected one segment after a snapshot, found %v", len(segments))
+	}
+	check("snapshot", 2, 500, 2001)
+	if snapshot, _ := wp.Snapshot(); !bytes.Equal(snapshot, []byte("snapshot")) {
+		t.Fatalf("reopened snapshot is %q", snapshot)
+	}
+
+	// 追加新日志时crash, 只写了半条记录
+	log = append(log, commandEntry(2, 2002))
+	store(1002, log[1001:])
+	wp.Close()
+	segments, _ := filepath.Glob(filepath.Join(walDir, "wal-*"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("opening segment: %v", err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+	_, meta, entries := replay("torn record")
+	if n := len(entries); meta.LastIncludedIndex+n != 1002 || entryCommand(entries[n-1]) != 2002 {
+		t.Fatalf("replaying a WAL with a torn record lost the last complete entry")
+	}
+	wp.Close()
+
+	servers := 3
+	cfg := make_config_on_disk(t, servers, false, DefaultOptions(), filepath.Join(dir, "cluster"), openWALPersister)
+	defer cfg.cleanup()
+
+	indexes := map[int]int{}
+	for i := 0; i < 20; i++ {
+		indexes[100+i] = cfg.one(100+i, servers)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.snapshot(i)
+	}
+	for i := 20; i < 30; i++ {
+		indexes[100+i] = cfg.one(100+i, servers)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	indexes[130] = cfg.one(130, servers)
+	for cmd, index := range indexes {
+		if n, v := cfg.nCommitted(index); n != servers || v != cmd {
+			t.Fatalf("entry %v is %v on %v servers after the restart; expected %v on all", index, v, n, cmd)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//持久化格式的测试逻辑：
+//1、被截断、校验和不对、版本号不认识的状态都返回错误，MakeWithOptions不会从任期0开始
+//2、WAL中间的一条记录损坏时打开WAL返回错误
+//3、版本1和两种没有头部的旧格式(gob依次编码各个字段，最初的格式只有term、votedFor和日志)的状态都能读出来，
+//  命令转换成编码后的字节，重启后马上按新格式重新保存
+func TestPersistedStateFormat(t *testing.T) {
+	fmt.Printf("Test (persist): checksummed, versioned state ...\n")
+
+	ps := persistentState{Term: 3, VotedFor: 1, Log: []Entry{commandEntry(1, 101), commandEntry(3, 102)}}
+	data := encodePersistentState(ps)
+	if got, legacy, err := decodePersistentState(data); err != nil || legacy || got.Term != 3 || len(got.Log) != 2 {
+		t.Fatalf("decoding encoded state: %+v, %v, %v", got, legacy, err)
+	}
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-3] ^= 0x10
+	newer := append([]byte{}, data...)
+	newer[len(stateMagic)] = stateVersion + 1
+
+	// 版本1: 命令是日志项里的接口值
+	w := new(bytes.Buffer)
+	gob.NewEncoder(w).Encode(persistentStateV1{Term: 3, VotedFor: 1, Log: legacyLog(ps.Log)})
+	v1 := append(append(append([]byte{}, stateMagic...), 1), frameRecord(w.Bytes())...)
+	if got, legacy, err := decodePersistentState(v1); err != nil || !legacy || len(got.Log) != 2 || entryCommand(got.Log[1]) != 102 {
+		t.Fatalf("decoding version 1 state: %+v, %v, %v", got, legacy, err)
+	}
+
+	// 加上快照之后、有版本号之前的格式
+	w = new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(3)
+	e.Encode(1)
+	e.Encode(1)
+	e.Encode(1)
+	e.Encode(Configuration{Servers: []int{0, 1, 2}})
+	e.Encode(legacyLog(ps.Log[1:]))
+	if got, legacy, err := decodePersistentState(w.Bytes()); err != nil || !legacy || got.LastIncludedIndex != 1 || len(got.Log) != 1 || entryCommand(got.Log[0]) != 102 {
+		t.Fatalf("decoding headerless state with a snapshot: %+v, %v, %v", got, legacy, err)
+	}
+
+	// 最初的格式: 和原来的persist()一样只编码currentTerm、votedFor和日志
+	baseline := baselineState(3, 1, ps.Log)
+	got, legacy, err := decodePersistentState(baseline)
+	if err != nil || !legacy || got.Term != 3 || got.VotedFor != 1 || got.LastIncludedIndex != 0 || len(got.Log) != 2 || entryCommand(got.Log[1]) != 102 {
+		t.Fatalf("decoding the original headerless state: %+v, %v, %v", got, legacy, err)
+	}
+	persister := MakePersister()
+	persister.SaveRaftState(baseline)
+	rf, err := MakeWithOptions(make([]*labrpc.ClientEnd, 3), 0, MakePersisterStorage(persister), make(chan ApplyMsg), DefaultOptions())
+	if err != nil {
+		t.Fatalf("MakeWithOptions() with the original state format: %v", err)
+	}
+	if term, _ := rf.GetState(); term != 3 {
+		t.Fatalf("restored term %v from the original state format; expected 3", term)
+	}
+	rf.Kill()
+
+	for _, c := range []struct {
+		what string
+		data []byte
+		err  error
+	}{
+		{"truncated state", data[:len(data)-1], ErrCorruptState},
+		{"flipped bit", flipped, ErrCorruptState},
+		{"newer version", newer, ErrUnsupportedVersion},
+		{"garbage", []byte{1, 2, 3}, ErrCorruptState},
+	} {
+		if _, _, err := decodePersistentState(c.data); err != c.err {
+			t.Fatalf("%v: decodePersistentState() returned %v; expected %v", c.what, err, c.err)
+		}
+		persister := MakePersister()
+		persister.SaveRaftState(c.data)
+		rf, err := MakeWithOptions(make([]*labrpc.ClientEnd, 3), 0, MakePersisterStorage(persister), make(chan ApplyMsg), DefaultOptions())
+		if rf != nil || err != c.err {
+			t.Fatalf("%v: MakeWithOptions() returned %v; expected %v", c.what, err, c.err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wp, err := MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister(): %v", err)
+	}
+	wp.StoreEntries(1, []Entry{commandEntry(1, 101)})
+	wp.StoreEntries(2, []Entry{commandEntry(1, 102)})
+	wp.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*"))
+	segment, _ := ioutil.ReadFile(segments[0])
+	segment[10] ^= 0x10
+	ioutil.WriteFile(segments[0], segment, 0644)
+	if _, err := MakeWALPersister(dir); err != ErrCorruptState {
+		t.Fatalf("opening a WAL with a corrupt record returned %v; expected ErrCorruptState", err)
+	}
+
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.one(101, servers)
+	cfg.one(102, servers)
+	cfg.crash1(0)
+	// 把server 0的状态改写成最初的格式
+	ps, _, err = decodePersistentState(cfg.saved[0].ReadRaftState())
+	if err != nil {
+		t.Fatalf("decoding server 0's state: %v", err)
+	}
+	cfg.saved[0].SaveRaftState(baselineState(ps.Term, ps.VotedFor, ps.Log))
+	cfg.start1(0)
+	if state := cfg.saved[0].ReadRaftState(); !bytes.HasPrefix(state, append(stateMagic, stateVersion)) {
+		t.Fatalf("state in the old format wasn't rewritten on restart")
+	}
+	cfg.connect(0)
+	cfg.one(103, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Storage出错时的测试逻辑：
+//1、启动时读不出状态，MakeWithOptions返回Storage的错误
+//2、写日志失败时raft直接panic，不会回复leader，Storage里只有失败之前的日志
+func TestStorageFailure(t *testing.T) {
+	fmt.Printf("Test (persist): storage failures ...\n")
+
+	net := labrpc.MakeNetwork()
+	ends := make([]*labrpc.ClientEnd, 3)
+	for i := range ends {
+		ends[i] = net.MakeEnd(randstring(20))
+	}
+	// 选举超时足够长, 测试期间server 0不会自己发起选举
+	opts := DefaultOptions()
+	opts.ElectionTimeoutMin = 10 * time.Second
+	opts.ElectionTimeoutMax = 20 * time.Second
+
+	persister := MakePersister()
+	fs := &faultyStorage{Storage: MakePersisterStorage(persister)}
+	atomic.StoreInt32(&fs.failReads, 1)
+	if rf, err := MakeWithOptions(ends, 0, fs, make(chan ApplyMsg, 10), opts); rf != nil || err != errInjected {
+		t.Fatalf("MakeWithOptions() on unreadable storage returned %v; expected errInjected", err)
+	}
+	atomic.StoreInt32(&fs.failReads, 0)
+
+	rf, err := MakeWithOptions(ends, 0, fs, make(chan ApplyMsg, 10), opts)
+	if err != nil {
+		t.Fatalf("MakeWithOptions(): %v", err)
+	}
+	defer rf.Kill()
+	args := AppendEntriesArgs{Term: 1, LeaderId: 1, Entries: []Entry{commandEntry(1, 101)}}
+	reply := AppendEntriesReply{}
+	rf.AppendEntries(&args, &reply)
+	if !reply.Success {
+		t.Fatalf("server rejected the first entry")
+	}
+
+	atomic.StoreInt32(&fs.failWrites, 1)
+	args = AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []Entry{commandEntry(1, 102)}}
+	reply = AppendEntriesReply{}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("AppendEntries() didn't panic when the entry couldn't be stored")
+			}
+		}()
+		rf.AppendEntries(&args, &reply)
+	}()
+	ps, _, err := decodePersistentState(persister.ReadRaftState())
+	if err != nil {
+		t.Fatalf("decoding stored state: %v", err)
+	}
+	if ps.Term != 1 || len(ps.Log) != 1 || entryCommand(ps.Log[0]) != 101 {
+		t.Fatalf("stored term %v and log %v; expected term 1 and only the first entry", ps.Term, ps.Log)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Codec的测试逻辑：
+//1、gob、JSON(指定类型和不指定类型)、raw三种Codec编码之后都能解码回原来的命令
+//2、RawCodec拒绝[]byte以外的命令和长度前缀不对的数据，编码不了的命令Propose返回Codec的错误
+//3、所有raft节点都使用JSONCodec，重启之后日志里的命令仍然能解码，提交的结果正确
+func TestCodec(t *testing.T) {
+	fmt.Printf("Test (codec): gob, JSON and raw commands ...\n")
+
+	type kv struct {
+		Key   string
+		Value int
+	}
+	gob.Register(kv{})
+	for _, c := range []struct {
+		codec    Codec
+		command  interface{}
+		expected interface{}
+	}{
+		{GobCodec{}, 42, 42},
+		{GobCodec{}, kv{"x", 1}, kv{"x", 1}},
+		{MakeJSONCodec(kv{}), kv{"x", 1}, kv{"x", 1}},
+		{MakeJSONCodec(nil), 42, float64(42)},
+		{RawCodec{}, []byte("raw"), []byte("raw")},
+	} {
+		data, err := c.codec.Encode(c.command)
+		if err != nil {
+			t.Fatalf("%T: encoding %v: %v", c.codec, c.command, err)
+		}
+		got, err := c.codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%T: decoding %v: %v", c.codec, c.command, err)
+		}
+		if fmt.Sprintf("%T %v", got, got) != fmt.Sprintf("%T %v", c.expected, c.expected) {
+			t.Fatalf("%T: %v decoded as %T %v; expected %T %v", c.codec, c.command, got, got, c.expected, c.expected)
+		}
+	}
+	if data, _ := (RawCodec{}).Encode([]byte("raw")); !bytes.Equal(data, []byte{0, 0, 0, 3, 'r', 'a', 'w'}) {
+		t.Fatalf("RawCodec encoded %q as %v", "raw", data)
+	}
+	if _, err := (RawCodec{}).Encode(42); err == nil {
+		t.Fatalf("RawCodec encoded an int")
+	}
+	if _, err := (RawCodec{}).Decode([]byte{0, 0, 0, 4, 'r', 'a', 'w'}); err != ErrBadRawCommand {
+		t.Fatalf("RawCodec decoded a command with the wrong length: %v", err)
+	}
+
+	servers := 3
+	opts := DefaultOptions()
+	opts.Codec = MakeJSONCodec(0)
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	cfg.one(101, servers)
+	leader := cfg.checkOneLeader()
+	// JSON编码不了channel
+	if index, err := cfg.rafts[leader].Propose(context.Background(), make(chan int)).Wait(); index != -1 || err == nil {
+		t.Fatalf("Propose() of a command the codec can't encode returned index %v, error %v", index, err)
+	}
+	cfg.one(102, servers)
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+	cfg.one(103, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Node的测试逻辑：
+//1、Node[op]使用JSONCodec，Propose和ApplyCh都是op类型，不需要类型断言
+//2、新leader追加的NoOp不会出现在ApplyCh里，第一条Applied就是提交的命令
+//3、解码出来的命令不是C时返回错误，Kill之后ApplyCh被关闭，再次Kill没有影响
+func TestNode(t *testing.T) {
+	fmt.Printf("Test (node): typed commands ...\n")
+
+	type op struct {
+		Key   string
+		Value int
+	}
+	servers := 3
+	opts := DefaultOptions()
+	opts.Codec = MakeJSONCodec(op{})
+	nodes := make_nodes[op](t, servers, opts)
+
+	index := -1
+	for start := time.Now(); index == -1 && time.Since(start) < 10*time.Second; {
+		for _, node := range nodes {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			i, err := node.Propose(ctx, op{"x", 1}).Wait()
+			cancel()
+			if err == nil {
+				index = i
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if index == -1 {
+		t.Fatalf("no node committed the command")
+	}
+	for i, node := range nodes {
+		select {
+		case a := <-node.ApplyCh():
+			if a.Index != index || a.UseSnapshot || a.Command.Key != "x" || a.Command.Value != 1 {
+				t.Fatalf("node %v applied %+v first; expected op{x 1} at index %v", i, a, index)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("node %v didn't apply the command", i)
+		}
+	}
+
+	data, _ := GobCodec{}.Encode("not an int")
+	if _, err := (typedCodec[int]{GobCodec{}}).Decode(data); err == nil {
+		t.Fatalf("typedCodec[int] decoded a string")
+	}
+
+	for _, node := range nodes {
+		node.Kill()
+	}
+	if _, ok := <-nodes[0].ApplyCh(); ok {
+		t.Fatalf("ApplyCh() is still open after Kill()")
+	}
+	nodes[0].Kill()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//TestTCPProcesses启动的子进程在这里运行raft节点，直接运行测试时什么也不做
+func TestTCPPeerProcess(t *testing.T) {
+	peers := os.Getenv("RAFT_TCP_PEERS")
+	if peers == "" {
+		return
+	}
+	me, _ := strconv.Atoi(os.Getenv("RAFT_TCP_ME"))
+	runTCPPeer(strings.Split(peers, ","), me, os.Getenv("RAFT_TCP_DIR"))
+}
+
+//多进程TCP的测试逻辑：
+//1、三个raft节点分别运行在独立的进程里，用Make创建，通过TCP通信，能够达成一致
+//2、杀掉一个进程，剩下两个仍然能提交新的日志
+//3、重新启动被杀掉的进程，它从磁盘恢复、重新连上其他进程，追上所有日志
+func TestTCPProcesses(t *testing.T) {
+	fmt.Printf("Test (tcp): servers in separate processes ...\n")
+
+	servers := 3
+	tc := make_tcp_cluster(t, servers)
+	defer tc.cleanup()
+
+	indexes := map[int]int{}
+	indexes[101] = tc.one(101, []int{0, 1, 2})
+	tc.crash1(0)
+	indexes[102] = tc.one(102, []int{1, 2})
+	tc.start1(0)
+	tc.one(103, []int{0, 1, 2})
+	for cmd, index := range indexes {
+		v := 0
+		if !tc.ends[0].Call("tcpPeer.Applied", index, &v) || v != cmd {
+			t.Fatalf("restarted server 0 hasn't applied entry %v", index)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//Transport的测试逻辑：
+//1、三个raft节点用MakeWithTransport创建，Transport直接调用对方的handler，不经过labrpc，能够达成一致
+//2、隔离leader之后，剩下两个节点选出新leader并提交新的日志
+//3、恢复连接后，原来的leader追上所有日志
+//4、发给某个server的RPC一直没有回复，Kill之后Transport收到的context被取消，这些RPC随之返回
+func TestTransport(t *testing.T) {
+	fmt.Printf("Test (transport): a Transport other than labrpc ...\n")
+
+	servers := 3
+	dn := make_direct_net(t, servers)
+	defer dn.cleanup()
+
+	dn.one(101, []int{0, 1, 2})
+	leader := -1
+	for i, rf := range dn.rafts {
+		if _, isLeader := rf.GetState(); isLeader {
+			leader = i
+		}
+	}
+	if leader == -1 {
+		t.Fatalf("no leader after agreement")
+	}
+	dn.isolate(leader, true)
+	others := []int{}
+	for i := 0; i < servers; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	dn.one(102, others)
+	dn.isolate(leader, false)
+	dn.one(103, []int{0, 1, 2})
+
+	dn.loseReplies(leader)
+	time.Sleep(RaftElectionTimeout)
+	if dn.pendingRPCs() == 0 {
+		t.Fatalf("no RPCs waiting for a reply that will never come")
+	}
+	for _, rf := range dn.rafts {
+		rf.Kill()
+	}
+	for t0 := time.Now(); dn.pendingRPCs() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(t0) > time.Second {
+			t.Fatalf("%v RPCs still waiting after Kill()", dn.pendingRPCs())
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//网络分区的测试逻辑：
+//1、leader和一个follower被分到少数派，多数派选出新leader并提交日志，旧leader收到的命令不会被提交
+//2、恢复网络后旧leader退位，所有server追上日志
+//3、server 2同时属于{0,1,2}和{2,3,4}两个分区，开启PreVote后另一边无法发起选举，leader和任期都保持不变
+func TestPartition(t *testing.T) {
+	servers := 5
+	opts := DefaultOptions()
+	opts.PreVote = true
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (partition): named partitions and a bridge server ...\n")
+
+	cfg.one(101, servers)
+
+	leader := cfg.checkOneLeader()
+	minority := []int{leader, (leader + 1) % servers}
+	majority := []int{(leader + 2) % servers, (leader + 3) % servers, (leader + 4) % servers}
+	cfg.partition(minority, majority)
+	index, _, ok := cfg.rafts[leader].Start(200)
+	if !ok {
+		t.Fatalf("leader %v rejected Start() right after the partition", leader)
+	}
+	cfg.one(102, len(majority))
+	if _, cmd := cfg.nCommitted(index); cmd == 200 {
+		t.Fatalf("the minority's leader committed a command")
+	}
+
+	cfg.heal()
+	cfg.one(103, servers)
+
+	cfg.partition([]int{0, 1, 2}, []int{2, 3, 4})
+	cfg.one(104, 3)
+	term1, _ := cfg.rafts[2].GetState()
+	time.Sleep(2 * RaftElectionTimeout)
+	if term2, _ := cfg.rafts[2].GetState(); term2 != term1 {
+		t.Fatalf("bridge server's term changed from %v to %v", term1, term2)
+	}
+	cfg.one(105, 3)
+
+	cfg.heal()
+	cfg.one(106, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//单向链路的测试逻辑：
+//1、follower发给leader的消息全部丢失，leader的AppendEntries仍然能到达它，日志照常提交，它也能apply
+//2、另一个follower发给leader的消息也丢失，leader收不到任何回复，开启CheckQuorum后退位，
+//   两个follower选出新leader并提交日志，旧leader的预投票得不到回复，不会打断它们
+//3、恢复网络后三个server都能达成一致
+func TestOneWayLink(t *testing.T) {
+	servers := 3
+	opts := DefaultOptions()
+	opts.PreVote = true
+	opts.CheckQuorum = true
+	cfg := make_config_with(t, servers, false, opts)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (partition): one-way links ...\n")
+
+	cfg.one(101, servers)
+
+	leader := cfg.checkOneLeader()
+	cfg.blockLink((leader+1)%servers, leader)
+	cfg.one(102, servers)
+
+	cfg.blockLink((leader+2)%servers, leader)
+	time.Sleep(2 * RaftElectionTimeout)
+	cfg.one(103, servers-1)
+	if leader2 := cfg.checkOneLeader(); leader2 == leader {
+		t.Fatalf("leader %v that can't hear from the others is still the leader", leader)
+	}
+
+	cfg.heal()
+	cfg.one(104, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//单条链路故障模型的测试逻辑：
+//1、server 4是高延迟、低带宽的异地副本，server 3所在的机架丢包、重复、乱序，其余链路正常
+//2、集群仍然能提交日志，而且所有server都能追上
+//3、去掉故障模型后照常达成一致
+func TestLinkProfiles(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (partition): a slow replica and a flaky rack ...\n")
+
+	wan := labrpc.LinkProfile{
+		Latency:    100 * time.Millisecond,
+		Jitter:     30 * time.Millisecond,
+		JitterDist: labrpc.Normal,
+		Bandwidth:  50000,
+	}
+	flaky := labrpc.LinkProfile{
+		Jitter:      10 * time.Millisecond,
+		LossRate:    0.2,
+		DupRate:     0.2,
+		ReorderRate: 0.1,
+	}
+	for i := 0; i < servers; i++ {
+		if i != 4 {
+			cfg.setLinkProfile(i, 4, wan)
+		}
+		if i != 3 && i != 4 {
+			cfg.setLinkProfile(i, 3, flaky)
+		}
+	}
+
+	for cmd := 101; cmd <= 110; cmd++ {
+		cfg.one(cmd, servers)
+	}
+
+	for i := 0; i < servers; i++ {
+		cfg.clearLinkProfile(i, 3)
+		cfg.clearLinkProfile(i, 4)
+	}
+	cfg.one(111, servers)
+
+	fmt.Printf("  ... Passed\n")
+}
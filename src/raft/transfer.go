@@ -0,0 +1,119 @@
+package raft
+
+//
+// 领导权转移(论文第3.10节 / 博士论文3.10节).
+//
+// leader先停止接受新的Start, 把目标server的日志补齐,
+// 然后发送TimeoutNow让目标立即发起选举, 不用等待选举超时.
+// 目标的日志是最新的, 而且比其他server更早开始选举, 所以几乎一定会当选.
+// 如果一个选举超时内转移没有完成, leader放弃转移并恢复正常工作.
+//
+
+import "time"
+
+type TimeoutNowArgs struct {
+	// leader的任期号
+	Term int
+	// leader的id
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	// 返回的任期号，方便leader知道自己是否过期
+	Term int
+}
+
+// 收到leader的TimeoutNow之后立即开始选举
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	DPrintf("Server %d: got TimeoutNow from leader %d, args: %+v, current term: %d\n", rf.me, args.LeaderId, args, rf.currentTerm)
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm || !rf.config.isVoter(rf.me) {
+		return
+	}
+	if args.Term > rf.currentTerm {
+		rf.convertToFollower(args.Term, -1)
+		reply.Term = rf.currentTerm
+	}
+	// 记下是哪个任期的TimeoutNow, 主循环据此丢弃过期的通知
+	rf.timeoutNowTerm = rf.currentTerm
+	rf.setTimeoutNowCh()
+}
+
+func (rf *Raft) sendTimeoutNow(server int, args *TimeoutNowArgs, reply *TimeoutNowReply) bool {
+	ok := rf.peer(server).TimeoutNow(rf.ctx, args, reply)
+	// Kill()之后当作没有收到回复, 不再改变状态
+	return ok && !rf.killed()
+}
+
+//
+// hand leadership over to target. the leader stops accepting Start()
+// calls, brings target's log up to date, and then tells it to start an
+// election right away. returns true once this server has stepped down
+// in favour of a newer leader, or false if it isn't the leader or the
+// transfer didn't finish within one election timeout, in which case it
+// carries on as leader.
+//
+func (rf *Raft) TransferLeadership(target int) bool {
+	rf.mu.Lock()
+	if rf.state != Leader || rf.transferTarget != -1 || target == rf.me || !rf.config.isVoter(target) {
+		rf.mu.Unlock()
+		return false
+	}
+	DPrintf("Leader %d: transfer leadership to server %d, current term: %d\n", rf.me, target, rf.currentTerm)
+	term := rf.currentTerm
+	rf.transferTarget = target
+	timeout := time.Duration(rf.electionTimeout) * time.Millisecond
+	// 目标的日志可能已经是最新的了
+	rf.maybeSendTimeoutNow(target)
+	rf.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if rf.killed() {
+			return false
+		}
+		rf.mu.Lock()
+		if rf.state != Leader || rf.currentTerm != term {
+			rf.mu.Unlock()
+			return true
+		}
+		rf.mu.Unlock()
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != Leader || rf.currentTerm != term {
+		return true
+	}
+	// 超时了, 放弃转移, 继续担任leader
+	DPrintf("Leader %d: transfer leadership to server %d timed out\n", rf.me, target)
+	rf.transferTarget = -1
+	return false
+}
+
+// 正在向server转移领导权并且它的日志已经和leader一样新时, 发送TimeoutNow
+// 调用时需要持有rf.mu
+func (rf *Raft) maybeSendTimeoutNow(server int) {
+	if rf.killed() || rf.state != Leader || rf.transferTarget != server || rf.matchIndex[server] < rf.getLastLogIndex() {
+		return
+	}
+	args := TimeoutNowArgs{
+		Term:     rf.currentTerm,
+		LeaderId: rf.me,
+	}
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		reply := TimeoutNowReply{}
+		if rf.sendTimeoutNow(server, &args, &reply) {
+			rf.mu.Lock()
+			if reply.Term > rf.currentTerm {
+				rf.convertToFollower(reply.Term, -1)
+			}
+			rf.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package raft
+
+//
+// Raft通过Transport给其他server发RPC, 不依赖labrpc.
+//
+// 每个peer一个Transport, 方法和Raft的RPC handler一一对应, 参数都是具体类型,
+// 不再通过"Raft.AppendEntries"这样的字符串找handler. 已经有自己的RPC栈的
+// service实现Transport把请求发出去, 对端收到之后直接调用Raft的同名handler
+// (rf.AppendEntries(args, reply)等)即可.
+//
+// MakeLabrpcTransport()把labrpc.ClientEnd包装成Transport, Make()和
+// MakeWithOptions()就是这样使用labrpc的; MakeTCPTransport()通过TCP连接
+// 对端用labrpc.ServeTCP()提供的Raft服务.
+//
+// 每个方法都会收到这个Raft的context, Kill()时取消, 还在等回复的RPC随之放弃.
+//
+
+import (
+	"context"
+	"labrpc"
+	"time"
+)
+
+//
+// sends Raft's RPCs to one other server. each method returns true if
+// the server executed the RPC and filled in reply, and false if it
+// couldn't be reached or didn't reply in time; a method must return
+// eventually, and may be called concurrently. ctx is canceled when
+// the calling Raft is killed, and the method should then give up and
+// return false promptly.
+//
+type Transport interface {
+	RequestVote(ctx context.Context, args *RequestVoteArgs, reply *RequestVoteReply) bool
+	AppendEntries(ctx context.Context, args *AppendEntriesArgs, reply *AppendEntriesReply) bool
+	InstallSnapshot(ctx context.Context, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool
+	TimeoutNow(ctx context.Context, args *TimeoutNowArgs, reply *TimeoutNowReply) bool
+	ForwardProposal(ctx context.Context, args *ForwardProposalArgs, reply *ForwardProposalReply) bool
+}
+
+type labrpcTransport struct {
+	end *labrpc.ClientEnd
+}
+
+// a Transport that calls the server's "Raft" labrpc service through end.
+func MakeLabrpcTransport(end *labrpc.ClientEnd) Transport {
+	return labrpcTransport{end}
+}
+
+//
+// a Transport to the server whose Raft is served with labrpc.ServeTCP()
+// at addr. an RPC fails if there's no reply within timeout.
+//
+func MakeTCPTransport(addr string, timeout time.Duration) Transport {
+	return MakeLabrpcTransport(labrpc.MakeTCPEnd(addr, timeout))
+}
+
+func (t labrpcTransport) RequestVote(ctx context.Context, args *RequestVoteArgs, reply *RequestVoteReply) bool {
+	return t.end.CallContext(ctx, "Raft.RequestVote", args, reply) == nil
+}
+
+func (t labrpcTransport) AppendEntries(ctx context.Context, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	return t.end.CallContext(ctx, "Raft.AppendEntries", args, reply) == nil
+}
+
+func (t labrpcTransport) InstallSnapshot(ctx context.Context, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
+	return t.end.CallContext(ctx, "Raft.InstallSnapshot", args, reply) == nil
+}
+
+func (t labrpcTransport) TimeoutNow(ctx context.Context, args *TimeoutNowArgs, reply *TimeoutNowReply) bool {
+	return t.end.CallContext(ctx, "Raft.TimeoutNow", args, reply) == nil
+}
+
+func (t labrpcTransport) ForwardProposal(ctx context.Context, args *ForwardProposalArgs, reply *ForwardProposalReply) bool {
+	return t.end.CallContext(ctx, "Raft.ForwardProposal", args, reply) == nil
+}
+
+// 把labrpc的端点换成Transport, nil仍然是nil(还不知道怎么联系的server)
+func labrpcTransports(ends []*labrpc.ClientEnd) []Transport {
+	peers := make([]Transport, len(ends))
+	for i, end := range ends {
+		if end != nil {
+			peers[i] = MakeLabrpcTransport(end)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,479 @@
+package raft
+
+//
+// 基于预写日志(WAL)的Storage, 每次persist()的开销只和变化的部分有关.
+//
+// 目录下有三种文件:
+//   meta            currentTerm和votedFor, 变化时整个重写(很小)
+//   wal-<seq>       日志记录, 按seq顺序追加; 一个segment写满后换下一个
+//   snapshot-<gen>  快照, 由检查点记录引用
+//
+// 一条日志记录表示"从Index开始的日志换成Log", 所以追加新日志和
+// 截掉冲突的日志都只需要追加一条记录. 快照时写一个新的segment作为检查点:
+// 开头是一条快照记录(lastIncludedIndex等), 后面是快照之后剩下的全部日志,
+// 写完之后通过rename原子地出现, 之前的segment和快照就可以删掉了.
+// 启动时按顺序重放所有segment得到日志; 最后一个segment末尾写了一半的记录
+// (追加时crash)会被截掉. 记录和meta都带有校验和(见format.go), 其他位置的
+// 记录损坏时返回错误.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	walMetaFileName  = "meta"
+	walSegmentPrefix = "wal-"
+	// segment超过这个大小之后, 新的记录写到下一个segment
+	walSegmentBytes = 1 << 20
+)
+
+type walRecord struct {
+	// 检查点: 之前的日志全部作废, 快照覆盖到LastIncludedIndex
+	Snapshot          bool
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	SnapshotConfig    Configuration
+	SnapshotGen       uint64
+	// 索引从Index开始的日志换成Log, Log为空时只是截断
+	Index int
+	Log   []Entry
+	// 命令还没有单独编码时写的记录用这个字段代替Log, 重放时转换
+	Entries []legacyEntry
+}
+
+type WALPersister struct {
+	mu  sync.Mutex
+	dir string
+	// 已经写到磁盘上的状态, 日志只记下任期号, 读日志时重放WAL
+	hardState HardState
+	meta      SnapshotMeta
+	terms     []int // meta.LastIncludedIndex之后每条日志的任期号
+	gen       uint64
+	snapshot  []byte
+	// 正在追加的segment
+	seq         uint64
+	segment     *os.File
+	segmentSize int64
+	size        int64 // 最近一个检查点以来所有segment的总大小
+}
+
+//
+// open (creating it if needed) a WALPersister that keeps its files in
+// dir, replaying whatever an earlier WALPersister saved there. only
+// one WALPersister may use a directory at a time. once a write has
+// failed, the WALPersister must not be used any more.
+//
+func MakeWALPersister(dir string) (*WALPersister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	wp := &WALPersister{dir: dir}
+	ps, found, err := wp.replay(true)
+	if err != nil {
+		return nil, err
+	}
+	wp.hardState = HardState{Term: ps.Term, VotedFor: ps.VotedFor}
+	if !found {
+		// 还没有保存过, 和Make()里的初始值一致
+		wp.hardState.VotedFor = -1
+	}
+	wp.meta = SnapshotMeta{
+		LastIncludedIndex: ps.LastIncludedIndex,
+		LastIncludedTerm:  ps.LastIncludedTerm,
+		Config:            ps.SnapshotConfig,
+	}
+	wp.terms = []int{}
+	for _, e := range ps.Log {
+		wp.terms = append(wp.terms, e.Term)
+	}
+	if wp.gen != 0 {
+		if wp.snapshot, err = ioutil.ReadFile(wp.snapshotPath(wp.gen)); err != nil {
+			return nil, err
+		}
+	}
+	if err := wp.removeStale(); err != nil {
+		return nil, err
+	}
+	return wp, nil
+}
+
+func (wp *WALPersister) segmentPath(seq uint64) string {
+	return filepath.Join(wp.dir, fmt.Sprintf("%s%016d", walSegmentPrefix, seq))
+}
+
+func (wp *WALPersister) snapshotPath(gen uint64) string {
+	return filepath.Join(wp.dir, snapshotPrefix+strconv.FormatUint(gen, 10))
+}
+
+// 目录下所有segment的编号, 从小到大
+func (wp *WALPersister) segments() ([]uint64, error) {
+	names, err := ioutil.ReadDir(wp.dir)
+	if err != nil {
+		return nil, err
+	}
+	seqs := []uint64{}
+	for _, fi := range names {
+		name := fi.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || strings.HasSuffix(name, tempSuffix) {
+			continue
+		}
+		if seq, err := strconv.ParseUint(strings.TrimPrefix(name, walSegmentPrefix), 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+//
+// 读出meta并按顺序重放所有segment, 得到磁盘上的raft状态, found表示是否保存过.
+// 同时记下快照版本、最后一个segment和大小; repair为true时截掉最后一个segment
+// 末尾写了一半的记录, 并打开它继续追加. 调用时需要持有wp.mu(或者还没有并发访问)
+//
+func (wp *WALPersister) replay(repair bool) (persistentState, bool, error) {
+	ps := persistentState{VotedFor: -1, Log: []Entry{}}
+	found := false
+	meta, err := ioutil.ReadFile(filepath.Join(wp.dir, walMetaFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return ps, false, err
+	}
+	if err == nil {
+		meta, err = readWholeRecord(meta)
+		if err != nil || len(meta) != 16 {
+			return ps, false, ErrCorruptState
+		}
+		ps.Term = int(int64(binary.BigEndian.Uint64(meta[:8])))
+		ps.VotedFor = int(int64(binary.BigEndian.Uint64(meta[8:])))
+		found = true
+	}
+
+	seqs, err := wp.segments()
+	if err != nil {
+		return ps, false, err
+	}
+	var gen uint64
+	var size, lastSize int64
+	for i, seq := range seqs {
+		last := i == len(seqs)-1
+		data, err := ioutil.ReadFile(wp.segmentPath(seq))
+		if err != nil {
+			return ps, false, err
+		}
+		off := 0
+		for off < len(data) {
+			rec, n, err := decodeWALRecord(data[off:])
+			// 最后一条记录校验和不对, 和没写完一样, 是追加时crash留下的
+			if err == ErrCorruptState && last && off+n == len(data) {
+				break
+			}
+			if err != nil {
+				DPrintf("WAL %v: record at offset %d of segment %d is unreadable: %v\n", wp.dir, off, seq, err)
+				return ps, false, err
+			}
+			if n == 0 {
+				break
+			}
+			off += n
+			found = true
+			if rec.Snapshot {
+				gen = rec.SnapshotGen
+				size = 0
+				ps.LastIncludedIndex = rec.LastIncludedIndex
+				ps.LastIncludedTerm = rec.LastIncludedTerm
+				ps.SnapshotConfig = rec.SnapshotConfig
+				ps.Log = []Entry{}
+				continue
+			}
+			keep := rec.Index - 1 - ps.LastIncludedIndex
+			entries := rec.Log
+			if keep < 0 {
+				// 快照已经覆盖了这些日志
+				if -keep > len(entries) {
+					entries = nil
+				} else {
+					entries = entries[-keep:]
+				}
+				keep = 0
+			}
+			if keep > len(ps.Log) {
+				DPrintf("WAL %v: entry %d follows entry %d in segment %d\n", wp.dir, rec.Index, ps.LastIncludedIndex+len(ps.Log), seq)
+				return ps, false, ErrCorruptState
+			}
+			ps.Log = append(ps.Log[:keep], entries...)
+		}
+		if off < len(data) {
+			// 只有最后一个segment的末尾可能是追加时crash留下的半条记录
+			if !last {
+				return ps, false, ErrCorruptState
+			}
+			if repair {
+				if err := os.Truncate(wp.segmentPath(seq), int64(off)); err != nil {
+					return ps, false, err
+				}
+			}
+		}
+		size += int64(off)
+		lastSize = int64(off)
+	}
+	if repair {
+		wp.gen = gen
+		wp.size = size
+		if len(seqs) > 0 {
+			wp.seq = seqs[len(seqs)-1]
+			wp.segmentSize = lastSize
+			if wp.segment, err = os.OpenFile(wp.segmentPath(wp.seq), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return ps, false, err
+			}
+		}
+	}
+	return ps, found, nil
+}
+
+// 删掉最近一个检查点之前的segment、没有被引用的快照和临时文件, 都是crash留下的
+func (wp *WALPersister) removeStale() error {
+	seqs, err := wp.segments()
+	if err != nil {
+		return err
+	}
+	// 找到最后一个以检查点开头的segment
+	checkpoint := uint64(0)
+	for _, seq := range seqs {
+		data, err := ioutil.ReadFile(wp.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		if rec, n, err := decodeWALRecord(data); err == nil && n > 0 && rec.Snapshot {
+			checkpoint = seq
+		}
+	}
+	for _, seq := range seqs {
+		if seq < checkpoint {
+			os.Remove(wp.segmentPath(seq))
+		}
+	}
+	names, err := ioutil.ReadDir(wp.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range names {
+		name := fi.Name()
+		stale := strings.HasSuffix(name, tempSuffix)
+		if strings.HasPrefix(name, snapshotPrefix) && !stale {
+			gen, err := strconv.ParseUint(strings.TrimPrefix(name, snapshotPrefix), 10, 64)
+			stale = err == nil && gen != wp.gen
+		}
+		if stale {
+			os.Remove(filepath.Join(wp.dir, name))
+		}
+	}
+	return nil
+}
+
+// 一条带校验的记录, 内容是gob编码的walRecord
+func encodeWALRecord(rec walRecord) []byte {
+	w := new(bytes.Buffer)
+	gob.NewEncoder(w).Encode(rec)
+	return frameRecord(w.Bytes())
+}
+
+// 解码data开头的一条记录, 返回它占用的字节数; 记录不完整时返回0, 损坏时返回ErrCorruptState
+func decodeWALRecord(data []byte) (walRecord, int, error) {
+	var rec walRecord
+	body, n, err := readRecord(data)
+	if err != nil || n == 0 {
+		return rec, n, err
+	}
+	if gob.NewDecoder(bytes.NewReader(body)).Decode(&rec) != nil {
+		return rec, n, ErrCorruptState
+	}
+	if len(rec.Entries) > 0 {
+		if rec.Log, err = convertLegacyEntries(rec.Entries); err != nil {
+			return rec, n, ErrCorruptState
+		}
+		rec.Entries = nil
+	}
+	return rec, n, nil
+}
+
+// 在当前segment末尾追加一条记录并fsync, 写满了就换一个新的segment, 调用时需要持有wp.mu
+func (wp *WALPersister) appendRecord(rec walRecord) error {
+	data := encodeWALRecord(rec)
+	if wp.segment == nil || wp.segmentSize >= walSegmentBytes {
+		if wp.segment != nil {
+			wp.segment.Close()
+		}
+		seq := wp.seq + 1
+		f, err := os.OpenFile(wp.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+		if err == nil {
+			err = syncDir(wp.dir)
+		}
+		if err != nil {
+			return err
+		}
+		wp.seq = seq
+		wp.segment = f
+		wp.segmentSize = 0
+	}
+	if _, err := wp.segment.Write(data); err != nil {
+		return err
+	}
+	if err := wp.segment.Sync(); err != nil {
+		return err
+	}
+	wp.segmentSize += int64(len(data))
+	wp.size += int64(len(data))
+	return nil
+}
+
+func (wp *WALPersister) InitialState() (HardState, SnapshotMeta, error) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.hardState, wp.meta, nil
+}
+
+// term和votedFor保存在meta里, 变化时整个重写
+func (wp *WALPersister) SetHardState(st HardState) error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if st == wp.hardState {
+		return nil
+	}
+	meta := make([]byte, 16)
+	binary.BigEndian.PutUint64(meta[:8], uint64(int64(st.Term)))
+	binary.BigEndian.PutUint64(meta[8:], uint64(int64(st.VotedFor)))
+	if err := writeFileAtomic(filepath.Join(wp.dir, walMetaFileName), frameRecord(meta)); err != nil {
+		return err
+	}
+	wp.hardState = st
+	return nil
+}
+
+func (wp *WALPersister) StoreEntries(index int, entries []Entry) error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	k := index - 1 - wp.meta.LastIncludedIndex
+	if k < 0 {
+		return ErrCompacted
+	}
+	if k > len(wp.terms) {
+		return ErrUnavailable
+	}
+	if err := wp.appendRecord(walRecord{Index: index, Log: entries}); err != nil {
+		return err
+	}
+	wp.terms = wp.terms[:k]
+	for _, e := range entries {
+		wp.terms = append(wp.terms, e.Term)
+	}
+	return nil
+}
+
+// 重放磁盘上的WAL, 只在Raft启动时用到
+func (wp *WALPersister) Entries(lo int, hi int) ([]Entry, error) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	ps, _, err := wp.replay(false)
+	if err != nil {
+		return nil, err
+	}
+	return sliceEntries(ps.Log, ps.LastIncludedIndex, lo, hi)
+}
+
+func (wp *WALPersister) LastIndex() (int, error) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.meta.LastIncludedIndex + len(wp.terms), nil
+}
+
+func (wp *WALPersister) SaveSnapshot(meta SnapshotMeta, snapshot []byte, entries []Entry) error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	gen := wp.gen + 1
+	if err := writeFileAtomic(wp.snapshotPath(gen), snapshot); err != nil {
+		return err
+	}
+	// 检查点segment一次写好再rename, 重放时要么完全看不到它, 要么看到完整的状态
+	data := encodeWALRecord(walRecord{
+		Snapshot:          true,
+		LastIncludedIndex: meta.LastIncludedIndex,
+		LastIncludedTerm:  meta.LastIncludedTerm,
+		SnapshotConfig:    meta.Config,
+		SnapshotGen:       gen,
+	})
+	data = append(data, encodeWALRecord(walRecord{Index: meta.LastIncludedIndex + 1, Log: entries})...)
+	seq := wp.seq + 1
+	if err := writeFileAtomic(wp.segmentPath(seq), data); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(wp.segmentPath(seq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if wp.segment != nil {
+		wp.segment.Close()
+	}
+	// 检查点之前的segment和旧快照都不再需要了
+	for old := wp.seq; old > 0; old-- {
+		if err := os.Remove(wp.segmentPath(old)); os.IsNotExist(err) {
+			break
+		}
+	}
+	if wp.gen != 0 {
+		os.Remove(wp.snapshotPath(wp.gen))
+	}
+	wp.seq = seq
+	wp.segment = f
+	wp.segmentSize = int64(len(data))
+	wp.size = int64(len(data))
+	wp.gen = gen
+	wp.snapshot = snapshot
+	wp.meta = meta
+	wp.terms = []int{}
+	for _, e := range entries {
+		wp.terms = append(wp.terms, e.Term)
+	}
+	return nil
+}
+
+func (wp *WALPersister) Snapshot() ([]byte, error) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.snapshot, nil
+}
+
+// 最近一个检查点以来WAL的大小, 随着日志增长, 快照之后变小
+func (wp *WALPersister) RaftStateSize() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return int(wp.size)
+}
+
+func (wp *WALPersister) SnapshotSize() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.snapshot)
+}
+
+// close the segment being appended to. the WALPersister must not be
+// used afterwards.
+func (wp *WALPersister) Close() error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.segment == nil {
+		return nil
+	}
+	err := wp.segment.Close()
+	wp.segment = nil
+	return err
+}